@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/fastimport"
+
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Authors map translates identities of bzr committers into git identities
+// and back. Every non-empty line of the file which isn't a comment looks like
+//
+//	Jane Doe <jane@host.localdomain> = Jane Doe <jane@example.com>
+//
+// with the bzr identity on the left. Identities without email can be written
+// just as a name. Both sides must be unique, so that identities round-trip.
+const authorsMapName = "git-bzr-bridge-authors.txt"
+
+type authorsMap struct {
+	toGit map[string]string
+	toBzr map[string]string
+}
+
+// Load authors map from the bridge directory, or nil if there is none
+func loadAuthorsMap() (*authorsMap, error) {
+	f, err := os.Open(authorsMapName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &authorsMap{make(map[string]string), make(map[string]string)}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: missing '='", authorsMapName, n)
+		}
+		from, err1 := normalizeIdent(line[:i])
+		to, err2 := normalizeIdent(line[i+1:])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%s:%d: invalid identity", authorsMapName, n)
+		}
+		if _, ok := m.toGit[from]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate bzr identity %q", authorsMapName, n, from)
+		}
+		if _, ok := m.toBzr[to]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate git identity %q", authorsMapName, n, to)
+		}
+		m.toGit[from] = to
+		m.toBzr[to] = from
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Bring identity to the "Name <email>" form used in fast-import streams
+func normalizeIdent(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", fmt.Errorf("empty identity")
+	}
+	lt := strings.Index(s, "<")
+	if lt < 0 {
+		return s + " <>", nil
+	}
+	if !strings.HasSuffix(s, ">") || strings.Count(s, "<") != 1 || strings.Count(s, ">") != 1 {
+		return "", fmt.Errorf("invalid identity %q", s)
+	}
+	name := strings.TrimSpace(s[:lt])
+	if name == "" {
+		return s[lt:], nil
+	}
+	return name + " " + s[lt:], nil
+}
+
+// Stream filter rewriting identities in author, committer and tagger
+// commands. If toBzr is true identities are translated back into bzr ones.
+func authorsFilter(m *authorsMap, toBzr bool) fastimport.Filter {
+	idents := m.toGit
+	if toBzr {
+		idents = m.toBzr
+	}
+	mapIdent := func(id *fastimport.Ident) {
+		if id == nil {
+			return
+		}
+		key, err := normalizeIdent(id.Name + " <" + id.Email + ">")
+		if err != nil {
+			return
+		}
+		if to, ok := idents[key]; ok {
+			lt := strings.Index(to, "<")
+			id.Name = strings.TrimSpace(to[:lt])
+			id.Email = to[lt+1 : len(to)-1]
+		}
+	}
+	return func(c fastimport.Command) (fastimport.Command, error) {
+		switch c := c.(type) {
+		case *fastimport.Commit:
+			for _, a := range c.Authors {
+				mapIdent(a)
+			}
+			mapIdent(c.Committer)
+		case *fastimport.Tag:
+			mapIdent(c.Tagger)
+		}
+		return c, nil
+	}
+}
@@ -40,7 +40,10 @@ func branchesCmd(args []string) {
 			if i != 0 {
 				fmt.Println("")
 			}
-			fmt.Printf("Git: %s\nUrl: %s\nBzr: %s\n", v.Git, v.Url, v.Bzr)
+			fmt.Printf("Git: %s\nUrl: %s\nBzr: %s\nMode: %s\n", v.Git, v.Url, v.Bzr, v.mode())
+			if v.Frozen {
+				fmt.Println("Frozen: yes")
+			}
 		}
 	}
 }
@@ -54,7 +57,8 @@ func branchesUsage(fs *flag.FlagSet) {
 	fmt.Print(`
 branches will list all branches known to git-bzr-bridge. Default output
 format will list git branch references one per line. If -v is specified
-it will also show Bzr urls and names of the (hidden) bzr branches.
+it will also show Bzr urls, names of the (hidden) bzr branches and
+directions of synchronization.
 `)
 }
 
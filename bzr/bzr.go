@@ -3,9 +3,14 @@ package bzr
 import (
 	l "github.com/usovalx/git-bzr-bridge/log"
 
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -74,6 +79,27 @@ func Clone(url, path string) error {
 	return run(bzr(append(flags, url, path)...))
 }
 
+// Returned by Pull when branches have diverged
+var ErrDiverged = errors.New("bzr: branches have diverged")
+
+// Pull new revisions from url into the existing branch
+func Pull(url, path string) error {
+	flags := []string{"pull", "-d", path}
+	if l.MinLogLevel > l.DEBUG {
+		flags = append(flags, "--quiet")
+	}
+	c := bzr(append(flags, url)...)
+	var stderr bytes.Buffer
+	c.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := run(c); err != nil {
+		if strings.Contains(stderr.String(), "have diverged") {
+			return ErrDiverged
+		}
+		return err
+	}
+	return nil
+}
+
 func Import(repoDir, inMarks, outMarks string) *exec.Cmd {
 	flags := []string{
 		"fast-import",
@@ -103,22 +129,175 @@ func Export(path, gitBranch, inMarks, outMarks string) *exec.Cmd {
 }
 
 func Tip(path string) (string, error) {
-	if out, err := bzr("revision-info", "-d", path).Output(); err != nil {
+	return revisionInfo(path)
+}
+
+// Get tip revision of the remote branch without fetching any revisions
+func RemoteTip(url string) (string, error) {
+	return revisionInfo(url)
+}
+
+func revisionInfo(path string) (string, error) {
+	out, err := bzr("revision-info", "-d", path).Output()
+	if err != nil {
 		return "", err
-	} else {
-		s := strings.Split(string(out), " ")
-		if len(s) != 2 {
-			return "", fmt.Errorf("bzr revision-info: invalid output %q", string(out))
+	}
+	s := strings.Split(string(out), " ")
+	if len(s) != 2 {
+		return "", fmt.Errorf("bzr revision-info: invalid output %q", string(out))
+	}
+	return strings.TrimSpace(string(s[1])), nil
+}
+
+// bzr has no command listing all revisions of the repository, so it's
+// provided by a tiny plugin loaded only for this call
+const revisionsPlugin = `from bzrlib.commands import Command, register_command
+
+class cmd_git_bzr_bridge_revisions(Command):
+    """List ids of all revisions in the repository."""
+    hidden = True
+    takes_args = ['location?']
+    encoding_type = 'exact'
+
+    def run(self, location='.'):
+        from bzrlib.repository import Repository
+        repo = Repository.open(location)
+        repo.lock_read()
+        try:
+            for key in repo.revisions.keys():
+                self.outf.write(key[-1] + '\n')
+        finally:
+            repo.unlock()
+
+register_command(cmd_git_bzr_bridge_revisions)
+`
+
+// Ids of all revisions in the repository at path, with a single bzr call
+func AllRevisions(path string) (map[string]bool, error) {
+	dir, err := ioutil.TempDir("", "git_bzr_bridge_plugin")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "__init__.py"), []byte(revisionsPlugin), 0666); err != nil {
+		return nil, err
+	}
+
+	c := bzr("git-bzr-bridge-revisions", path)
+	c.Env = append(os.Environ(), "BZR_PLUGINS_AT=git_bzr_bridge@"+dir)
+	out, err := c.Output()
+	if err != nil {
+		return nil, err
+	}
+	revs := make(map[string]bool)
+	for _, r := range strings.Split(string(out), "\n") {
+		if r != "" {
+			revs[r] = true
 		}
-		return strings.TrimSpace(string(s[1])), nil
 	}
-	panic("unreachable")
+	return revs, nil
+}
+
+// Find revision id of the revision with the given (possibly dotted) revno
+func RevisionId(path, revno string) (string, error) {
+	out, err := bzr("revision-info", "-d", path, "-r", revno).Output()
+	if err != nil {
+		return "", err
+	}
+	s := strings.Fields(string(out))
+	if len(s) != 2 {
+		return "", fmt.Errorf("bzr revision-info: invalid output %q", string(out))
+	}
+	return s[1], nil
+}
+
+// Find revision numbers (dotted for merged revisions) of the revisions
+// on the branch. Returns a map from revision id to revno.
+func RevisionNumbers(path string, revids []string) (map[string]string, error) {
+	const batch = 100
+	res := make(map[string]string)
+	for len(revids) > 0 {
+		n := len(revids)
+		if n > batch {
+			n = batch
+		}
+		args := []string{"revision-info", "-d", path}
+		for _, r := range revids[:n] {
+			args = append(args, "revid:"+r)
+		}
+		revids = revids[n:]
+
+		out, err := bzr(args...).Output()
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			s := strings.Fields(line)
+			if len(s) == 0 {
+				continue
+			}
+			if len(s) != 2 {
+				return nil, fmt.Errorf("bzr revision-info: invalid output %q", line)
+			}
+			res[s[1]] = s[0]
+		}
+	}
+	return res, nil
+}
+
+// Get all tags of the branch as a map from tag name to revision id
+func Tags(path string) (map[string]string, error) {
+	out, err := bzr("tags", "--show-ids", "-d", path).Output()
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("bzr tags: invalid output %q", line)
+		}
+		tags[strings.TrimSpace(line[:i])] = line[i+1:]
+	}
+	return tags, nil
+}
+
+// Create new tag in the branch (which can be a url as well)
+func SetTag(branch, name, rev string) error {
+	return run(bzr("tag", "-d", branch, "-r", "revid:"+rev, name))
+}
+
+func DeleteTag(branch, name string) error {
+	return run(bzr("tag", "--delete", "-d", branch, name))
+}
+
+// Check whether branch at url contains all revisions of the local branch
+func Contains(url, branch string) (bool, error) {
+	err := bzr("missing", "--mine-only", "-d", branch, url).Run()
+	if err == nil {
+		return true, nil
+	}
+	// missing exits with 1 if there are some revisions missing
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, err
 }
 
 func PullOverwrite(from, to string) error {
 	return run(bzr("pull", "--overwrite", "-d", to, from))
 }
 
+// Move tip of the branch to the given revision, which must
+// already be present in the repository
+func ResetTip(branch, rev string) error {
+	return run(bzr("pull", "--overwrite", "-d", branch, "-r", "revid:"+rev, branch))
+}
+
 func NewBranch(branch, rev string) error {
 	err := run(bzr("init", "--create-prefix", branch))
 	if err != nil {
@@ -131,6 +310,11 @@ func Push(branch, url string) error {
 	return run(bzr("push", "-d", branch, url))
 }
 
+// Push branch into url even if they have diverged, replacing its history
+func PushOverwrite(branch, url string) error {
+	return run(bzr("push", "--overwrite", "-d", branch, url))
+}
+
 // Prepare exec.Cmd to run bzr with specified arguments
 func bzr(args ...string) *exec.Cmd {
 	a := append(conf.BzrCommand, args...)
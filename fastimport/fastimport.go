@@ -0,0 +1,138 @@
+// Parser and serializer of git fast-import streams, as produced by
+// git fast-export and bzr fast-export
+package fastimport
+
+import (
+	"io"
+)
+
+// Command is a single top-level command of the stream: *Commit, *Blob,
+// *Reset, *Tag, *Progress, *Checkpoint, *Feature, *Option or *Done
+type Command interface {
+	command()
+}
+
+// Identity in author, committer and tagger commands
+type Ident struct {
+	Name  string // can be empty
+	Email string // can be empty as well, but <> are always there
+	When  string // raw date as it appears in the stream
+}
+
+type Commit struct {
+	Ref         string
+	Mark        string // e.g. ":12", empty if not set
+	OriginalOid string
+	// bzr fast-export can produce several authors
+	Authors   []*Ident
+	Committer *Ident
+	Encoding  string
+	Message   []byte
+	From      string
+	Merges    []string
+	Files     []*FileCommand
+}
+
+// Kinds of file commands
+const (
+	FileModify    = "M"
+	FileDelete    = "D"
+	FileCopy      = "C"
+	FileRename    = "R"
+	FileDeleteAll = "deleteall"
+	NoteModify    = "N"
+)
+
+// File or note change in a commit
+type FileCommand struct {
+	Op   string
+	Mode string // M only
+	// mark, object name or "inline" for M and N
+	DataRef string
+	// inline data for M and N
+	Data []byte
+	// path for M, D, C and R; commit-ish for N
+	Path string
+	// destination for C and R
+	Dest string
+}
+
+type Blob struct {
+	Mark        string
+	OriginalOid string
+	Data        []byte
+}
+
+type Reset struct {
+	Ref  string
+	From string // optional
+}
+
+type Tag struct {
+	Name        string
+	Mark        string
+	From        string
+	OriginalOid string
+	Tagger      *Ident // optional
+	Message     []byte
+}
+
+type Progress struct {
+	Message string
+}
+
+type Checkpoint struct{}
+
+// Feature and option commands are kept as is, e.g. "done" or "export-marks=file"
+type Feature struct {
+	Feature string
+}
+
+type Option struct {
+	Option string
+}
+
+type Done struct{}
+
+func (*Commit) command()     {}
+func (*Blob) command()       {}
+func (*Reset) command()      {}
+func (*Tag) command()        {}
+func (*Progress) command()   {}
+func (*Checkpoint) command() {}
+func (*Feature) command()    {}
+func (*Option) command()     {}
+func (*Done) command()       {}
+
+// Filter is a single stage of stream processing. It can modify the command
+// in place, replace it with another one, or drop it by returning nil.
+type Filter func(Command) (Command, error)
+
+// Copy stream from r to w passing all commands through the filters in order
+func Run(w io.Writer, r io.Reader, filters ...Filter) error {
+	p := NewParser(r)
+	s := NewWriter(w)
+	for {
+		c, err := p.Next()
+		if err == io.EOF {
+			return s.Flush()
+		}
+		if err != nil {
+			return err
+		}
+		for _, f := range filters {
+			if c, err = f(c); err != nil {
+				return err
+			}
+			if c == nil {
+				break
+			}
+		}
+		if c == nil {
+			continue
+		}
+		if err := s.Write(c); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package fastimport
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roughly what git fast-export produces
+const gitStream = `feature done
+blob
+mark :1
+data 6
+hello
+
+reset refs/heads/master
+commit refs/heads/master
+mark :2
+author Jane Doe <jane@example.com> 1400000000 +0100
+committer Jane Doe <jane@example.com> 1400000000 +0100
+data 15
+initial commit
+M 100644 :1 hello.txt
+M 100644 :1 "with \"quotes\"\nand newline"
+
+commit refs/heads/master
+mark :3
+author Jane Doe <jane@example.com> 1400000100 +0100
+committer Jane Doe <jane@example.com> 1400000100 +0100
+data 7
+rename
+from :2
+R "dir with spaces/a" b c
+D hello.txt
+C b c "d"
+
+tag v1
+from :3
+tagger Jane Doe <jane@example.com> 1400000200 +0100
+data 3
+v1
+
+done
+`
+
+// roughly what bzr fast-export --plain produces
+const bzrStream = `commit refs/heads/master
+mark :1
+committer jdoe <> 1300000000 +0000
+data 5
+first
+M 644 inline README
+data 4
+foo
+
+commit refs/heads/master
+mark :2
+author Jane Doe <jane@host.localdomain> 1300000100 +0000
+author <other@host> 1300000100 +0000
+committer jdoe <> 1300000100 +0000
+data <<EOT
+merge
+EOT
+from :1
+merge :1
+deleteall
+M 755 inline bin/run
+data 0
+N inline :1
+data 4
+note
+progress 2 commits
+checkpoint
+
+`
+
+func parseAll(t *testing.T, s string) []Command {
+	p := NewParser(strings.NewReader(s))
+	var res []Command
+	for {
+		c, err := p.Next()
+		if err == io.EOF {
+			return res
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, c)
+	}
+}
+
+func writeAll(t *testing.T, cmds []Command) string {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, c := range cmds {
+		if err := w.Write(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestParseGitStream(t *testing.T) {
+	cmds := parseAll(t, gitStream)
+	if len(cmds) != 7 {
+		t.Fatalf("Expected 7 commands, got %d", len(cmds))
+	}
+	if f, ok := cmds[0].(*Feature); !ok || f.Feature != "done" {
+		t.Errorf("Wrong feature: %#v", cmds[0])
+	}
+	if b := cmds[1].(*Blob); b.Mark != ":1" || string(b.Data) != "hello\n" {
+		t.Errorf("Wrong blob: %#v", b)
+	}
+	if r := cmds[2].(*Reset); r.Ref != "refs/heads/master" || r.From != "" {
+		t.Errorf("Wrong reset: %#v", r)
+	}
+
+	c := cmds[3].(*Commit)
+	want := &Ident{"Jane Doe", "jane@example.com", "1400000000 +0100"}
+	if len(c.Authors) != 1 || !reflect.DeepEqual(c.Authors[0], want) || !reflect.DeepEqual(c.Committer, want) {
+		t.Errorf("Wrong identities: %#v %#v", c.Authors, c.Committer)
+	}
+	if string(c.Message) != "initial commit\n" || c.From != "" {
+		t.Errorf("Wrong commit: %#v", c)
+	}
+	if len(c.Files) != 2 || c.Files[1].Path != "with \"quotes\"\nand newline" {
+		t.Errorf("Wrong files: %#v", c.Files)
+	}
+
+	c = cmds[4].(*Commit)
+	if c.From != ":2" || len(c.Files) != 3 {
+		t.Fatalf("Wrong commit: %#v", c)
+	}
+	if f := c.Files[0]; f.Op != FileRename || f.Path != "dir with spaces/a" || f.Dest != "b c" {
+		t.Errorf("Wrong rename: %#v", f)
+	}
+	if f := c.Files[2]; f.Op != FileCopy || f.Path != "b" || f.Dest != "c \"d\"" {
+		t.Errorf("Wrong copy: %#v", f)
+	}
+
+	tag := cmds[5].(*Tag)
+	if tag.Name != "v1" || tag.From != ":3" || tag.Tagger == nil || string(tag.Message) != "v1\n" {
+		t.Errorf("Wrong tag: %#v", tag)
+	}
+	if _, ok := cmds[6].(*Done); !ok {
+		t.Errorf("Expected done, got %#v", cmds[6])
+	}
+}
+
+func TestParseBzrStream(t *testing.T) {
+	cmds := parseAll(t, bzrStream)
+	if len(cmds) != 4 {
+		t.Fatalf("Expected 4 commands, got %d", len(cmds))
+	}
+	c := cmds[0].(*Commit)
+	if c.Committer.Name != "jdoe" || c.Committer.Email != "" || len(c.Authors) != 0 {
+		t.Errorf("Wrong committer: %#v", c.Committer)
+	}
+	if len(c.Files) != 1 || string(c.Files[0].Data) != "foo\n" {
+		t.Errorf("Wrong inline data: %#v", c.Files)
+	}
+
+	c = cmds[1].(*Commit)
+	if len(c.Authors) != 2 || c.Authors[1].Name != "" || c.Authors[1].Email != "other@host" {
+		t.Errorf("Wrong authors: %#v %#v", c.Authors[0], c.Authors[1])
+	}
+	if string(c.Message) != "merge\n" || c.From != ":1" || !reflect.DeepEqual(c.Merges, []string{":1"}) {
+		t.Errorf("Wrong commit: %#v", c)
+	}
+	if len(c.Files) != 3 || c.Files[0].Op != FileDeleteAll || c.Files[1].Mode != "755" {
+		t.Fatalf("Wrong files: %#v", c.Files)
+	}
+	if n := c.Files[2]; n.Op != NoteModify || n.Path != ":1" || string(n.Data) != "note" {
+		t.Errorf("Wrong note: %#v", n)
+	}
+
+	if p := cmds[2].(*Progress); p.Message != "2 commits" {
+		t.Errorf("Wrong progress: %#v", p)
+	}
+	if _, ok := cmds[3].(*Checkpoint); !ok {
+		t.Errorf("Expected checkpoint, got %#v", cmds[3])
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, s := range []string{gitStream, bzrStream} {
+		cmds := parseAll(t, s)
+		out := writeAll(t, cmds)
+		if again := parseAll(t, out); !reflect.DeepEqual(cmds, again) {
+			t.Errorf("Stream changed after round trip:\n%s", out)
+		}
+		if out2 := writeAll(t, parseAll(t, out)); out2 != out {
+			t.Errorf("Serialization isn't stable:\n%s\n---\n%s", out, out2)
+		}
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		isSource bool
+		quoted   string
+	}{
+		{"plain/path", false, "plain/path"},
+		{"with space", false, "with space"},
+		{"with space", true, `"with space"`},
+		{`"starts with quote`, false, `"\"starts with quote"`},
+		{"tab\there", false, `"tab\there"`},
+		{"bell\a", false, `"bell\007"`},
+		{"back\\slash", false, "back\\slash"},
+		{"ünicode", false, "ünicode"},
+	}
+	for _, tt := range tests {
+		q := quotePath(tt.path, tt.isSource)
+		if q != tt.quoted {
+			t.Errorf("quotePath(%q) = %s, expected %s", tt.path, q, tt.quoted)
+		}
+		path, rest, err := unquotePath(q, tt.isSource)
+		if err != nil || path != tt.path || rest != "" {
+			t.Errorf("unquotePath(%s) = %q, %q, %v", q, path, rest, err)
+		}
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	bad := []string{
+		"bogus\n",
+		"commit refs/heads/x\ndata 0\n",
+		"commit refs/heads/x\ncommitter broken\ndata 0\n",
+		"commit refs/heads/x\ncommitter a <b> 1 +0000\ndata 10\nshort",
+		"commit refs/heads/x\ncommitter a <b> 1 +0000\ndata <<EOT\nno end\n",
+		"blob\nmark 12\ndata 0\n",
+		"tag v1\ndata 0\n",
+		"commit refs/heads/x\ncommitter a <b> 1 +0000\ndata 0\nM 644 :1\n",
+		"commit refs/heads/x\ncommitter a <b> 1 +0000\ndata 0\nR \"unterminated b\n",
+	}
+	for _, s := range bad {
+		p := NewParser(strings.NewReader(s))
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Expected syntax error for %q, got %v", s, err)
+		}
+	}
+}
+
+func TestRunFilters(t *testing.T) {
+	dropBlobs := func(c Command) (Command, error) {
+		if _, ok := c.(*Blob); ok {
+			return nil, nil
+		}
+		return c, nil
+	}
+	var seen []string
+	rename := func(c Command) (Command, error) {
+		if c, ok := c.(*Commit); ok {
+			seen = append(seen, c.Ref)
+			c.Ref = "refs/heads/renamed"
+		}
+		return c, nil
+	}
+
+	var buf bytes.Buffer
+	if err := Run(&buf, strings.NewReader(gitStream), dropBlobs, rename); err != nil {
+		t.Fatal(err)
+	}
+	cmds := parseAll(t, buf.String())
+	if len(cmds) != 6 || len(seen) != 2 {
+		t.Fatalf("Unexpected output:\n%s", buf.String())
+	}
+	for _, c := range cmds {
+		if _, ok := c.(*Blob); ok {
+			t.Error("Blob wasn't dropped")
+		}
+		if c, ok := c.(*Commit); ok && c.Ref != "refs/heads/renamed" {
+			t.Errorf("Commit wasn't renamed: %s", c.Ref)
+		}
+	}
+}
+
+// Whatever the parser accepts must survive serialization unchanged
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte(gitStream))
+	f.Add([]byte(bzrStream))
+	f.Add([]byte("commit r\ncommitter <> 0 +0000\ndata 0\nR \"a\\001\" \"b\"\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := NewParser(bytes.NewReader(data))
+		var cmds []Command
+		for {
+			c, err := p.Next()
+			if err != nil {
+				break
+			}
+			cmds = append(cmds, c)
+		}
+		out := writeAll(t, cmds)
+		again := parseAll(t, out)
+		if len(cmds) == 0 && len(again) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(cmds, again) {
+			t.Fatalf("Stream changed after round trip:\n%q\n---\n%q", data, out)
+		}
+	})
+}
@@ -0,0 +1,482 @@
+package fastimport
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Parser reads commands from the stream one by one
+type Parser struct {
+	r      *bufio.Reader
+	lineno int
+	// line pushed back after looking ahead
+	pending *string
+}
+
+func NewParser(r io.Reader) *Parser {
+	return &Parser{r: bufio.NewReader(r)}
+}
+
+// Parse error with the line number where it was found
+type SyntaxError struct {
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("fast-import stream, line %d: %s", e.Line, e.Msg)
+}
+
+func (p *Parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{p.lineno, fmt.Sprintf(format, args...)}
+}
+
+// Read next line without trailing LF. Returns io.EOF at the end of stream.
+func (p *Parser) readLine() (string, error) {
+	if p.pending != nil {
+		l := *p.pending
+		p.pending = nil
+		return l, nil
+	}
+	l, err := p.r.ReadString('\n')
+	if err == io.EOF && l != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	p.lineno++
+	return strings.TrimSuffix(l, "\n"), nil
+}
+
+func (p *Parser) unreadLine(l string) {
+	p.pending = &l
+}
+
+// Read next line which isn't empty or a comment. Such lines
+// are allowed (and ignored) between the commands.
+func (p *Parser) nextLine() (string, error) {
+	for {
+		l, err := p.readLine()
+		if err != nil || (l != "" && l[0] != '#') {
+			return l, err
+		}
+	}
+}
+
+// Read optional "<keyword> <value>" line
+func (p *Parser) optional(keyword string) (string, bool, error) {
+	l, err := p.nextLine()
+	if err == io.EOF {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if v, ok := cutCommand(l, keyword); ok {
+		return v, true, nil
+	}
+	p.unreadLine(l)
+	return "", false, nil
+}
+
+// Split "<keyword> <value>" line
+func cutCommand(l, keyword string) (string, bool) {
+	if strings.HasPrefix(l, keyword+" ") {
+		return l[len(keyword)+1:], true
+	}
+	return "", false
+}
+
+// Next returns the next command of the stream, or io.EOF at the end of it
+func (p *Parser) Next() (Command, error) {
+	l, err := p.nextLine()
+	if err != nil {
+		return nil, err
+	}
+	cmd, arg := l, ""
+	if i := strings.Index(l, " "); i >= 0 {
+		cmd, arg = l[:i], l[i+1:]
+	}
+	switch cmd {
+	case "commit":
+		return p.parseCommit(arg)
+	case "blob":
+		return p.parseBlob()
+	case "reset":
+		return p.parseReset(arg)
+	case "tag":
+		return p.parseTag(arg)
+	case "progress":
+		return &Progress{arg}, nil
+	case "checkpoint":
+		return &Checkpoint{}, nil
+	case "feature":
+		return &Feature{arg}, nil
+	case "option":
+		return &Option{arg}, nil
+	case "done":
+		return &Done{}, nil
+	}
+	return nil, p.errorf("unsupported command %q", cmd)
+}
+
+func (p *Parser) parseCommit(ref string) (*Commit, error) {
+	if ref == "" {
+		return nil, p.errorf("commit without reference")
+	}
+	c := &Commit{Ref: ref}
+	var err error
+	if c.Mark, c.OriginalOid, err = p.parseMarkAndOid(); err != nil {
+		return nil, err
+	}
+	for {
+		v, ok, err := p.optional("author")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		a, err := p.parseIdent(v)
+		if err != nil {
+			return nil, err
+		}
+		c.Authors = append(c.Authors, a)
+	}
+	v, ok, err := p.optional("committer")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, p.errorf("commit without committer")
+	}
+	if c.Committer, err = p.parseIdent(v); err != nil {
+		return nil, err
+	}
+	if c.Encoding, _, err = p.optional("encoding"); err != nil {
+		return nil, err
+	}
+	if c.Message, err = p.parseData(); err != nil {
+		return nil, err
+	}
+	if c.From, _, err = p.optional("from"); err != nil {
+		return nil, err
+	}
+	for {
+		v, ok, err := p.optional("merge")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		c.Merges = append(c.Merges, v)
+	}
+	for {
+		f, err := p.parseFileCommand()
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			return c, nil
+		}
+		c.Files = append(c.Files, f)
+	}
+}
+
+func (p *Parser) parseMarkAndOid() (mark, oid string, err error) {
+	if mark, _, err = p.optional("mark"); err != nil {
+		return
+	}
+	if mark != "" && !validMark(mark) {
+		return "", "", p.errorf("invalid mark %q", mark)
+	}
+	oid, _, err = p.optional("original-oid")
+	return
+}
+
+func validMark(m string) bool {
+	if len(m) < 2 || m[0] != ':' {
+		return false
+	}
+	n, err := strconv.ParseUint(m[1:], 10, 64)
+	return err == nil && n > 0 && strconv.FormatUint(n, 10) == m[1:]
+}
+
+// Read file command of the commit, or nil if there are no more of them
+func (p *Parser) parseFileCommand() (*FileCommand, error) {
+	l, err := p.nextLine()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l == FileDeleteAll {
+		return &FileCommand{Op: FileDeleteAll}, nil
+	}
+	if len(l) < 2 || l[1] != ' ' {
+		p.unreadLine(l)
+		return nil, nil
+	}
+
+	f := &FileCommand{Op: l[:1]}
+	arg := l[2:]
+	switch f.Op {
+	case FileModify:
+		// M <mode> <dataref> <path>
+		parts := strings.SplitN(arg, " ", 3)
+		if len(parts) != 3 {
+			return nil, p.errorf("invalid filemodify %q", l)
+		}
+		f.Mode, f.DataRef = parts[0], parts[1]
+		if f.Path, err = p.lastPath(parts[2]); err != nil {
+			return nil, err
+		}
+	case FileDelete:
+		if f.Path, err = p.lastPath(arg); err != nil {
+			return nil, err
+		}
+	case FileCopy, FileRename:
+		var rest string
+		f.Path, rest, err = unquotePath(arg, true)
+		if err != nil || f.Path == "" || !strings.HasPrefix(rest, " ") {
+			return nil, p.errorf("invalid path in %q", l)
+		}
+		if f.Dest, err = p.lastPath(rest[1:]); err != nil {
+			return nil, err
+		}
+	case NoteModify:
+		// N <dataref> <commit-ish>
+		parts := strings.SplitN(arg, " ", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, p.errorf("invalid notemodify %q", l)
+		}
+		f.DataRef, f.Path = parts[0], parts[1]
+	default:
+		p.unreadLine(l)
+		return nil, nil
+	}
+	if (f.Op == FileModify || f.Op == NoteModify) && f.DataRef == "inline" {
+		if f.Data, err = p.parseData(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Path taking the rest of the line
+func (p *Parser) lastPath(s string) (string, error) {
+	path, rest, err := unquotePath(s, false)
+	if err != nil || rest != "" || path == "" {
+		return "", p.errorf("invalid path %q", s)
+	}
+	return path, nil
+}
+
+func (p *Parser) parseBlob() (*Blob, error) {
+	b := new(Blob)
+	var err error
+	if b.Mark, b.OriginalOid, err = p.parseMarkAndOid(); err != nil {
+		return nil, err
+	}
+	if b.Data, err = p.parseData(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (p *Parser) parseReset(ref string) (*Reset, error) {
+	if ref == "" {
+		return nil, p.errorf("reset without reference")
+	}
+	r := &Reset{Ref: ref}
+	var err error
+	if r.From, _, err = p.optional("from"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (p *Parser) parseTag(name string) (*Tag, error) {
+	if name == "" {
+		return nil, p.errorf("tag without name")
+	}
+	t := &Tag{Name: name}
+	var err error
+	if t.Mark, _, err = p.optional("mark"); err != nil {
+		return nil, err
+	}
+	if t.Mark != "" && !validMark(t.Mark) {
+		return nil, p.errorf("invalid mark %q", t.Mark)
+	}
+	from, ok, err := p.optional("from")
+	if err != nil {
+		return nil, err
+	}
+	if !ok || from == "" {
+		return nil, p.errorf("tag without from")
+	}
+	t.From = from
+	if t.OriginalOid, _, err = p.optional("original-oid"); err != nil {
+		return nil, err
+	}
+	v, ok, err := p.optional("tagger")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if t.Tagger, err = p.parseIdent(v); err != nil {
+			return nil, err
+		}
+	}
+	if t.Message, err = p.parseData(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Parse "[<name> ]<<email>> <when>"
+func (p *Parser) parseIdent(s string) (*Ident, error) {
+	lt := strings.Index(s, "<")
+	gt := strings.Index(s, ">")
+	if lt < 0 || gt < lt || !strings.HasPrefix(s[gt+1:], " ") {
+		return nil, p.errorf("invalid identity %q", s)
+	}
+	id := &Ident{
+		Name:  strings.TrimSuffix(s[:lt], " "),
+		Email: s[lt+1 : gt],
+		When:  s[gt+2:],
+	}
+	if id.When == "" || strings.Contains(id.Name, ">") {
+		return nil, p.errorf("invalid identity %q", s)
+	}
+	return id, nil
+}
+
+// Read data command, either "data <count>" or "data <<<delim>"
+func (p *Parser) parseData() ([]byte, error) {
+	l, err := p.nextLine()
+	if err == io.EOF {
+		return nil, p.errorf("unexpected end of stream, expected data")
+	}
+	if err != nil {
+		return nil, err
+	}
+	arg, ok := cutCommand(l, "data")
+	if !ok {
+		return nil, p.errorf("expected data, got %q", l)
+	}
+
+	if strings.HasPrefix(arg, "<<") {
+		delim := arg[2:]
+		if delim == "" {
+			return nil, p.errorf("empty data delimiter")
+		}
+		var buf bytes.Buffer
+		for {
+			l, err := p.readLine()
+			if err == io.EOF {
+				return nil, p.errorf("unexpected end of stream in data")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if l == delim {
+				return dataBytes(&buf), nil
+			}
+			buf.WriteString(l)
+			buf.WriteByte('\n')
+		}
+	}
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return nil, p.errorf("invalid data length %q", arg)
+	}
+	// don't trust the length too much, read only what is there
+	var buf bytes.Buffer
+	copied, err := io.CopyN(&buf, p.r, n)
+	if err == io.EOF || copied != n {
+		return nil, p.errorf("unexpected end of stream in data")
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.lineno += bytes.Count(buf.Bytes(), []byte("\n"))
+	return dataBytes(&buf), nil
+}
+
+// Empty data is always nil, whichever way it was read
+func dataBytes(buf *bytes.Buffer) []byte {
+	if buf.Len() == 0 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Unquote C-style quoted path at the start of s. If it isn't quoted, path ends
+// at the first space when stopAtSpace is set, or at the end of s otherwise.
+// Returns the path and the rest of s.
+func unquotePath(s string, stopAtSpace bool) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		if stopAtSpace {
+			if i := strings.Index(s, " "); i >= 0 {
+				return s[:i], s[i:], nil
+			}
+		}
+		return s, "", nil
+	}
+
+	var buf bytes.Buffer
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return buf.String(), s[i+1:], nil
+		case c != '\\':
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			break
+		}
+		switch c = s[i]; c {
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'v':
+			buf.WriteByte('\v')
+		case '"', '\\':
+			buf.WriteByte(c)
+		case '0', '1', '2', '3':
+			if i+2 >= len(s) {
+				return "", "", fmt.Errorf("invalid escape in %q", s)
+			}
+			v, err := strconv.ParseUint(s[i:i+3], 8, 8)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid escape in %q", s)
+			}
+			buf.WriteByte(byte(v))
+			i += 2
+		default:
+			return "", "", fmt.Errorf("invalid escape in %q", s)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted path %q", s)
+}
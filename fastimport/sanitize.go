@@ -0,0 +1,163 @@
+package fastimport
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Message used for commits which came with an empty one
+const EmptyMessage = "(no message)\n"
+
+// Sanitize returns filter repairing known defects of the streams produced by
+// bzr-fastimport and git fast-export:
+//   - empty commit messages
+//   - deletes of paths which aren't there anymore (deleted or moved away
+//     earlier in the same commit, or after deleteall)
+//   - renames and copies of paths after they were deleted, or after their
+//     parent directory was renamed in the same commit
+//
+// The filter only sees the stream and not the trees of commits it builds on,
+// so deletes of paths which are missing from the parent commit (rather than
+// removed earlier in the same commit) are passed through as they are.
+//
+// Every fix is reported through report. In strict mode the filter fails
+// on the first defect instead of repairing it.
+func Sanitize(strict bool, report func(c *Commit, fix string)) Filter {
+	return func(cmd Command) (Command, error) {
+		c, ok := cmd.(*Commit)
+		if !ok {
+			return cmd, nil
+		}
+		var err error
+		fix := func(format string, args ...interface{}) bool {
+			if err != nil {
+				return false
+			}
+			msg := fmt.Sprintf(format, args...)
+			if strict {
+				err = fmt.Errorf("commit %s: %s", commitName(c), msg)
+				return false
+			}
+			report(c, msg)
+			return true
+		}
+
+		if len(bytes.TrimSpace(c.Message)) == 0 && fix("empty commit message") {
+			c.Message = []byte(EmptyMessage)
+		}
+		sanitizeFiles(c, fix)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// Name of the commit for messages
+func commitName(c *Commit) string {
+	if c.Mark != "" {
+		return c.Mark + " of " + c.Ref
+	}
+	return "of " + c.Ref
+}
+
+// Is path the same as dir or inside of it
+func isUnder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+func sanitizeFiles(c *Commit, fix func(string, ...interface{}) bool) {
+	// paths removed from the tree by the commands processed so far,
+	// and paths (re)created after that
+	gone := make(map[string]bool)
+	added := make(map[string]bool)
+	allGone := false
+	isGone := func(path string) bool {
+		if added[path] {
+			return false
+		}
+		if allGone {
+			return true
+		}
+		for p := path; ; {
+			if gone[p] {
+				return true
+			}
+			i := strings.LastIndex(p, "/")
+			if i < 0 {
+				return false
+			}
+			p = p[:i]
+		}
+	}
+	var renames []*FileCommand
+
+	var out []*FileCommand
+	for _, f := range c.Files {
+		switch f.Op {
+		case FileDeleteAll:
+			gone, added, renames = make(map[string]bool), make(map[string]bool), nil
+			allGone = true
+
+		case FileModify:
+			added[f.Path] = true
+
+		case FileDelete:
+			if isGone(f.Path) {
+				if fix("delete of missing path %q", f.Path) {
+					continue
+				}
+			}
+			gone[f.Path] = true
+			delete(added, f.Path)
+
+		case FileRename, FileCopy:
+			// source is inside of a directory which was renamed earlier
+			for i := len(renames) - 1; i >= 0; i-- {
+				r := renames[i]
+				if isUnder(f.Path, r.Path) && !added[f.Path] && r.Path != f.Path {
+					moved := r.Dest + f.Path[len(r.Path):]
+					if fix("%s of %q after its directory was renamed to %q", f.Op, f.Path, r.Dest) {
+						f.Path = moved
+					}
+					break
+				}
+			}
+			// source was deleted earlier, move this command before the delete
+			if isGone(f.Path) {
+				if i := deletedAt(out, f.Path); i >= 0 && fix("%s of %q after it was deleted", f.Op, f.Path) {
+					if out[i].Path == f.Path && f.Op == FileRename {
+						// the delete is redundant now
+						out[i] = f
+					} else {
+						out = append(out[:i], append([]*FileCommand{f}, out[i:]...)...)
+					}
+					if f.Op == FileRename {
+						renames = append(renames, f)
+					}
+					added[f.Dest] = true
+					continue
+				}
+			}
+			if f.Op == FileRename {
+				gone[f.Path] = true
+				delete(added, f.Path)
+				renames = append(renames, f)
+			}
+			added[f.Dest] = true
+		}
+		out = append(out, f)
+	}
+	c.Files = out
+}
+
+// Index of the first delete command removing path, or -1
+func deletedAt(files []*FileCommand, path string) int {
+	for i, f := range files {
+		if f.Op == FileDelete && isUnder(path, f.Path) {
+			return i
+		}
+	}
+	return -1
+}
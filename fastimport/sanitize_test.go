@@ -0,0 +1,98 @@
+package fastimport
+
+import (
+	"strings"
+	"testing"
+)
+
+func sanitizeCommit(t *testing.T, strict bool, files string) (*Commit, []string, error) {
+	s := "commit refs/heads/master\nmark :1\ncommitter a <b> 1 +0000\ndata 4\nmsg\n" + files
+	cmds := parseAll(t, s)
+	var fixes []string
+	c, err := Sanitize(strict, func(c *Commit, fix string) {
+		fixes = append(fixes, fix)
+	})(cmds[0])
+	if err != nil {
+		return nil, fixes, err
+	}
+	return c.(*Commit), fixes, nil
+}
+
+func fileLines(t *testing.T, c *Commit) string {
+	out := writeAll(t, []Command{&Commit{Ref: "r", Committer: c.Committer, Files: c.Files}})
+	i := strings.Index(out, "data 0\n\n")
+	return out[i+len("data 0\n\n") : len(out)-1]
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name, in, out string
+		fixes         int
+	}{
+		{"clean",
+			"M 644 :2 a\nR b c\nD d\n",
+			"M 644 :2 a\nR b c\nD d\n", 0},
+		{"double delete",
+			"D a\nD a\n",
+			"D a\n", 1},
+		{"delete inside deleted directory",
+			"D dir\nD dir/a\n",
+			"D dir\n", 1},
+		{"delete after rename",
+			"R a b\nD a\n",
+			"R a b\n", 1},
+		{"delete after deleteall",
+			"deleteall\nM 644 :2 a\nD a\nD b\n",
+			"deleteall\nM 644 :2 a\nD a\n", 1},
+		{"delete of re-added path",
+			"D a\nM 644 :2 a\nD a\n",
+			"D a\nM 644 :2 a\nD a\n", 0},
+		{"rename after delete",
+			"D a\nR a b\n",
+			"R a b\n", 1},
+		{"rename after delete of parent",
+			"M 644 :2 x\nD dir\nR dir/a b\n",
+			"M 644 :2 x\nR dir/a b\nD dir\n", 1},
+		{"copy after delete",
+			"D a\nC a b\n",
+			"C a b\nD a\n", 1},
+		{"rename inside renamed directory",
+			"R dir new\nR dir/a new/b\n",
+			"R dir new\nR new/a new/b\n", 1},
+	}
+	for _, tt := range tests {
+		c, fixes, err := sanitizeCommit(t, false, tt.in)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if out := fileLines(t, c); out != tt.out {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tt.name, tt.out, out)
+		}
+		if len(fixes) != tt.fixes {
+			t.Errorf("%s: expected %d fixes, got %q", tt.name, tt.fixes, fixes)
+		}
+
+		_, _, err = sanitizeCommit(t, true, tt.in)
+		if (err != nil) != (tt.fixes != 0) {
+			t.Errorf("%s: unexpected result in strict mode: %v", tt.name, err)
+		}
+	}
+}
+
+func TestSanitizeEmptyMessage(t *testing.T) {
+	cmds := parseAll(t, "commit refs/heads/master\ncommitter a <b> 1 +0000\ndata 2\n \n")
+	fixed := 0
+	c, err := Sanitize(false, func(*Commit, string) { fixed++ })(cmds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c.(*Commit).Message) != EmptyMessage || fixed != 1 {
+		t.Errorf("Empty message wasn't fixed: %q", c.(*Commit).Message)
+	}
+
+	cmds = parseAll(t, "commit refs/heads/master\ncommitter a <b> 1 +0000\ndata 0\n")
+	if _, err := Sanitize(true, nil)(cmds[0]); err == nil {
+		t.Error("Empty message accepted in strict mode")
+	}
+}
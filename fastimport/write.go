@@ -0,0 +1,180 @@
+package fastimport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Writer serializes commands back into the stream
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Flush buffered data into the underlying writer
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) line(parts ...string) {
+	for _, p := range parts {
+		if w.err == nil {
+			_, w.err = w.w.WriteString(p)
+		}
+	}
+	if w.err == nil {
+		w.err = w.w.WriteByte('\n')
+	}
+}
+
+func (w *Writer) optional(keyword, value string) {
+	if value != "" {
+		w.line(keyword, " ", value)
+	}
+}
+
+func (w *Writer) data(d []byte) {
+	w.line("data ", strconv.Itoa(len(d)))
+	if w.err == nil {
+		_, w.err = w.w.Write(d)
+	}
+	// optional LF, keeps the stream readable
+	w.line()
+}
+
+func (w *Writer) ident(keyword string, id *Ident) {
+	if id.Name == "" {
+		w.line(keyword, " <", id.Email, "> ", id.When)
+	} else {
+		w.line(keyword, " ", id.Name, " <", id.Email, "> ", id.When)
+	}
+}
+
+// Write single command into the stream
+func (w *Writer) Write(c Command) error {
+	if w.err != nil {
+		return w.err
+	}
+	switch c := c.(type) {
+	case *Commit:
+		if c.Committer == nil {
+			return fmt.Errorf("commit %s without committer", c.Ref)
+		}
+		w.line("commit ", c.Ref)
+		w.optional("mark", c.Mark)
+		w.optional("original-oid", c.OriginalOid)
+		for _, a := range c.Authors {
+			w.ident("author", a)
+		}
+		w.ident("committer", c.Committer)
+		w.optional("encoding", c.Encoding)
+		w.data(c.Message)
+		w.optional("from", c.From)
+		for _, m := range c.Merges {
+			w.line("merge ", m)
+		}
+		for _, f := range c.Files {
+			w.fileCommand(f)
+		}
+		w.line()
+	case *Blob:
+		w.line("blob")
+		w.optional("mark", c.Mark)
+		w.optional("original-oid", c.OriginalOid)
+		w.data(c.Data)
+	case *Reset:
+		w.line("reset ", c.Ref)
+		w.optional("from", c.From)
+		w.line()
+	case *Tag:
+		w.line("tag ", c.Name)
+		w.optional("mark", c.Mark)
+		w.line("from ", c.From)
+		w.optional("original-oid", c.OriginalOid)
+		if c.Tagger != nil {
+			w.ident("tagger", c.Tagger)
+		}
+		w.data(c.Message)
+	case *Progress:
+		w.line("progress ", c.Message)
+	case *Checkpoint:
+		w.line("checkpoint")
+		w.line()
+	case *Feature:
+		w.line("feature ", c.Feature)
+	case *Option:
+		w.line("option ", c.Option)
+	case *Done:
+		w.line("done")
+	default:
+		return fmt.Errorf("unknown command %T", c)
+	}
+	return w.err
+}
+
+func (w *Writer) fileCommand(f *FileCommand) {
+	switch f.Op {
+	case FileModify:
+		w.line("M ", f.Mode, " ", f.DataRef, " ", quotePath(f.Path, false))
+	case FileDelete:
+		w.line("D ", quotePath(f.Path, false))
+	case FileCopy, FileRename:
+		w.line(f.Op, " ", quotePath(f.Path, true), " ", quotePath(f.Dest, false))
+	case FileDeleteAll:
+		w.line(FileDeleteAll)
+	case NoteModify:
+		w.line("N ", f.DataRef, " ", f.Path)
+	default:
+		if w.err == nil {
+			w.err = fmt.Errorf("unknown file command %q", f.Op)
+		}
+		return
+	}
+	if (f.Op == FileModify || f.Op == NoteModify) && f.DataRef == "inline" {
+		w.data(f.Data)
+	}
+}
+
+// C-style quote path if it can't be written as is. Source paths of copy
+// and rename commands have to be quoted if they contain spaces.
+func quotePath(path string, isSource bool) string {
+	needQuotes := strings.HasPrefix(path, `"`) || (isSource && strings.Contains(path, " "))
+	for i := 0; i < len(path) && !needQuotes; i++ {
+		needQuotes = path[i] < ' ' || path[i] == 0x7f
+	}
+	if !needQuotes {
+		return path
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(&b, `\%03o`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Exit codes of fsck, or'ed together if several kinds of problems are found
+const (
+	fsckMarks    = 4  // marks files are broken or don't match each other
+	fsckObjects  = 8  // marked git objects or bzr revisions are missing
+	fsckBranches = 16 // branch config or branches are broken
+	fsckJournal  = 32 // interrupted transaction needs recovery
+	fsckTooling  = 64 // some checks couldn't be done
+)
+
+type fsckProblem struct {
+	Check   string
+	Subject string
+	Message string
+}
+
+var fsckChecks = map[string]int{
+	"marks-syntax":   fsckMarks,
+	"marks-mismatch": fsckMarks,
+	"git-object":     fsckObjects,
+	"bzr-revision":   fsckObjects,
+	"config":         fsckBranches,
+	"bzr-branch":     fsckBranches,
+	"git-branch":     fsckBranches,
+	"tip-mismatch":   fsckBranches,
+	"journal":        fsckJournal,
+	"bzr-tooling":    fsckTooling,
+}
+
+type fsckReport struct {
+	Problems []*fsckProblem
+	ExitCode int
+}
+
+func (r *fsckReport) add(check, subject, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, &fsckProblem{check, subject, fmt.Sprintf(format, args...)})
+	r.ExitCode |= fsckChecks[check]
+}
+
+func fsckCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	asJson := fs.Bool("json", false, "print report as JSON")
+	quick := fs.Bool("quick", false, "don't check that marked bzr revisions exist (lists all revisions of the bzr repo)")
+	fs.Usage = func() { fsckUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	r := func() *fsckReport {
+		lk := lockRepo()
+		defer lk.Release()
+		return fsck(!*quick)
+	}()
+
+	if *asJson {
+		must(json.NewEncoder(os.Stdout).Encode(r))
+	} else {
+		for _, p := range r.Problems {
+			fmt.Printf("%s\t%s\t%s\n", p.Check, p.Subject, p.Message)
+		}
+	}
+	os.Exit(r.ExitCode)
+}
+
+// Check consistency of the bridge. Caller must hold repository lock.
+func fsck(checkBzr bool) *fsckReport {
+	r := new(fsckReport)
+	if exists(journalName) {
+		r.add("journal", journalName, "interrupted transaction, run recover")
+	}
+
+	bm := fsckMarksFile(r, bzrMarks)
+	gm := fsckMarksFile(r, gitMarks)
+	if bm != nil && gm != nil {
+		fsckMarksMatch(r, bm, gm, checkBzr)
+	}
+
+	c, err := loadBranchConfig()
+	if err != nil {
+		r.add("config", branchConfigName, "%s", err)
+		return r
+	}
+	if _, err := loadBridgeConfig(); err != nil {
+		r.add("config", bridgeConfigName, "%s", err)
+	}
+	for _, b := range c.branches {
+		fsckBranch(r, b, bm, gm)
+	}
+	return r
+}
+
+// Strictly parse marks file, returns nil if it can't be read at all
+func fsckMarksFile(r *fsckReport, path string) *marks {
+	f, err := os.Open(path)
+	if err != nil {
+		r.add("marks-syntax", path, "%s", err)
+		return nil
+	}
+	defer f.Close()
+
+	m := &marks{byMark: make(map[int]string), byRev: make(map[string]int)}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for lineno := 1; s.Scan(); lineno++ {
+		where := fmt.Sprintf("%s:%d", path, lineno)
+		fields := strings.Split(s.Text(), " ")
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], ":") || fields[1] == "" {
+			r.add("marks-syntax", where, "invalid line %q", s.Text())
+			continue
+		}
+		mark, rev := fields[0][1:], fields[1]
+		n, err := strconv.Atoi(mark)
+		if err != nil || n <= 0 {
+			r.add("marks-syntax", where, "invalid mark %q", fields[0])
+			continue
+		}
+		if _, ok := m.byMark[n]; ok {
+			r.add("marks-syntax", where, "duplicate mark %d", n)
+		}
+		if _, ok := m.byRev[rev]; ok {
+			r.add("marks-syntax", where, "duplicate revision %s", rev)
+		}
+		m.byMark[n] = rev
+		m.byRev[rev] = n
+	}
+	if err := s.Err(); err != nil {
+		r.add("marks-syntax", path, "%s", err)
+	}
+	return m
+}
+
+// Check that every mark has both git and bzr side, and that they exist
+func fsckMarksMatch(r *fsckReport, bm, gm *marks, checkBzr bool) {
+	var objects []string
+	for _, obj := range gm.byMark {
+		objects = append(objects, obj)
+	}
+	types := make(map[string]string)
+	if len(objects) > 0 {
+		var err error
+		types, err = git.ObjectTypes(objects)
+		must(err)
+	}
+	var revisions map[string]bool
+	if checkBzr && len(bm.byMark) > 0 {
+		var err error
+		revisions, err = bzr.AllRevisions(bzrRepo)
+		if err != nil {
+			// it's our plugin failing rather than revisions missing
+			r.add("bzr-tooling", bzrRepo, "can't list revisions, existence of bzr revisions isn't checked: %s", err)
+		}
+	}
+
+	var all []int
+	for mark := range gm.byMark {
+		all = append(all, mark)
+	}
+	for mark := range bm.byMark {
+		if _, ok := gm.byMark[mark]; !ok {
+			all = append(all, mark)
+		}
+	}
+	sort.Ints(all)
+
+	for _, mark := range all {
+		subject := ":" + strconv.Itoa(mark)
+		obj, inGit := gm.byMark[mark]
+		revid, inBzr := bm.byMark[mark]
+		if inGit && types[obj] == "missing" {
+			r.add("git-object", subject, "git object %s doesn't exist", obj)
+		}
+		switch {
+		case !inGit:
+			r.add("marks-mismatch", subject, "bzr revision %s has no git commit", revid)
+		case !inBzr && types[obj] == "commit":
+			// fast-import also records marks of blobs, they have no bzr side
+			r.add("marks-mismatch", subject, "git commit %s has no bzr revision", obj)
+		case inBzr && types[obj] != "commit" && types[obj] != "missing":
+			r.add("marks-mismatch", subject, "bzr revision %s is marked as git %s %s", revid, types[obj], obj)
+		}
+		if inBzr && revisions != nil && !revisions[revid] {
+			r.add("bzr-revision", subject, "bzr revision %s doesn't exist", revid)
+		}
+	}
+}
+
+// Check that both sides of the branch exist and point to the same revision
+func fsckBranch(r *fsckReport, b *branchInfo, bm, gm *marks) {
+	bzrTip, err := bzr.Tip(b.Bzr)
+	if err != nil {
+		r.add("bzr-branch", b.Git, "can't read bzr branch %s: %s", b.Bzr, err)
+	}
+	// archived branches are usually deleted from git
+	if b.Frozen {
+		return
+	}
+	gitTip, err := git.ResolveRef("refs/heads/" + b.Git)
+	must(err)
+	if gitTip == "" {
+		r.add("git-branch", b.Git, "git branch doesn't exist")
+	}
+	if bzrTip == "" || bzrTip == "null:" || gitTip == "" || bm == nil || gm == nil {
+		return
+	}
+	commit, ok := bm.translate(bzrTip, gm)
+	switch {
+	case !ok:
+		r.add("tip-mismatch", b.Git, "bzr tip %s isn't in the marks files", bzrTip)
+	case commit != gitTip:
+		r.add("tip-mismatch", b.Git, "bzr tip %s is git commit %s, but git branch points to %s", bzrTip, commit, gitTip)
+	}
+}
+
+func fsckUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge fsck [-h] [-json] [-quick]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+fsck will check consistency of the bridge: that marks files can be parsed and
+match each other, that all marked git objects and bzr revisions exist, and that
+all branches from the branch config exist both in git and bzr and point
+to the same revision. It doesn't change anything.
+
+Problems are printed one per line as <check> <subject> <message> separated
+by tabs, or as a JSON object with -json. Exit code tells which kinds
+of problems were found, it's a sum of:
+  4  marks files are broken or don't match each other
+  8  marked git objects or bzr revisions are missing
+  16 branch config or branches are broken
+  32 interrupted transaction needs to be recovered
+  64 some checks couldn't be done, e.g. bzr revisions couldn't be listed
+     by the bundled bzr plugin (use -quick to skip that check)
+`)
+}
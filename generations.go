@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every transaction saves a generation: marks files and branch config as they
+// were before it, together with its journal. Generations are kept in stateDir
+// as 1 (the latest one), 2 and so on, and are used by rollback to undo the last
+// few transactions.
+const stateDir = "git-bzr-bridge-state"
+
+// Name of the generation description in its directory
+const generationInfo = "generation.json"
+
+// Files saved in every generation
+var generationFiles = []string{bzrMarks, gitMarks, branchConfigName}
+
+type generation struct {
+	N       int `json:"-"`
+	Time    time.Time
+	Command string
+	Journal *journal
+	// hidden bzr branches removed by the transaction are moved into the
+	// generation instead of being deleted, step number -> directory name
+	Kept map[int]string `json:",omitempty"`
+}
+
+func generationDir(n int) string {
+	return filepath.Join(stateDir, strconv.Itoa(n))
+}
+
+// Start new generation before running the transaction. Returns its temporary
+// directory, or empty string if generations are disabled.
+// Caller must hold repository lock.
+func beginGeneration() string {
+	bc, err := loadBridgeConfig()
+	must(err)
+	if bc.Generations < 0 {
+		return ""
+	}
+	dir, err := ioutil.TempDir(tmpDir, "generation")
+	must(err)
+	// all these files are always replaced and never changed in place,
+	// so hard links are as good as copies
+	for _, f := range generationFiles {
+		if err := os.Link(f, filepath.Join(dir, f)); err != nil && !os.IsNotExist(err) {
+			os.RemoveAll(dir)
+			panic(err)
+		}
+	}
+	return dir
+}
+
+// Record finished transaction in the generation started by beginGeneration,
+// and make it the latest one
+func saveGeneration(dir string, j *journal) error {
+	bc, err := loadBridgeConfig()
+	if err != nil {
+		return err
+	}
+	g := &generation{
+		Time:    time.Now(),
+		Command: strings.Join(os.Args[1:], " "),
+		Journal: j,
+		Kept:    make(map[int]string),
+	}
+	cleanup := make(map[string]bool)
+	for _, f := range j.CleanupFiles {
+		cleanup[f] = true
+	}
+	for i, s := range j.Steps {
+		if s.Op == stepRenameDir && cleanup[s.To] && exists(s.To) {
+			name := fmt.Sprintf("bzr-branch-%d", i)
+			if err := os.Rename(s.To, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			g.Kept[i] = name
+		}
+	}
+	data, err := json.MarshalIndent(g, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, generationInfo), data, 0666); err != nil {
+		return err
+	}
+
+	// shift older generations, dropping the ones which aren't needed anymore
+	if err := os.MkdirAll(stateDir, 0777); err != nil {
+		return err
+	}
+	old, err := generationNumbers()
+	if err != nil {
+		return err
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		n := old[i]
+		if n >= bc.Generations {
+			os.RemoveAll(generationDir(n))
+			continue
+		}
+		if err := os.Rename(generationDir(n), generationDir(n+1)); err != nil {
+			return err
+		}
+	}
+	return os.Rename(dir, generationDir(1))
+}
+
+// Numbers of existing generations in ascending order
+func generationNumbers() ([]int, error) {
+	entries, err := ioutil.ReadDir(stateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && n > 0 && e.IsDir() {
+			all = append(all, n)
+		}
+	}
+	sort.Ints(all)
+	return all, nil
+}
+
+func loadGeneration(n int) (*generation, error) {
+	name := filepath.Join(generationDir(n), generationInfo)
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	g := &generation{N: n}
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if g.Journal == nil {
+		return nil, fmt.Errorf("%s: journal is missing", name)
+	}
+	return g, nil
+}
+
+// Steps undoing git references and hidden bzr branches changed by the
+// transaction, in the reverse order. Marks files and branch config aren't
+// touched, they are restored from the oldest rolled back generation.
+func (g *generation) undoSteps() ([]*journalStep, []string) {
+	var steps []*journalStep
+	var cleanup []string
+	for i := len(g.Journal.Steps) - 1; i >= 0; i-- {
+		s := g.Journal.Steps[i]
+		switch s.Op {
+		case stepRenameDir:
+			if name, ok := g.Kept[i]; ok {
+				steps = append(steps, &journalStep{Op: stepRenameDir,
+					From: filepath.Join(generationDir(g.N), name), To: s.From})
+			} else if isTemporary(s.From) {
+				trash := filepath.Join(tmpDir, tempBranchName())
+				steps = append(steps, &journalStep{Op: stepRenameDir, From: s.To, To: trash})
+				cleanup = append(cleanup, trash)
+			} else {
+				steps = append(steps, &journalStep{Op: stepRenameDir, From: s.To, To: s.From})
+			}
+		case stepGitBranch:
+			steps = append(steps, &journalStep{Op: stepSetRef, From: s.Undo, To: "refs/heads/" + s.To})
+		case stepBzrPull, stepBzrReset:
+			steps = append(steps, &journalStep{Op: stepBzrReset, From: s.Undo, To: s.To})
+		case stepMoveRef:
+			steps = append(steps, &journalStep{Op: stepMoveRef, From: s.To, To: s.From})
+		case stepCopyRef:
+			steps = append(steps, &journalStep{Op: stepSetRef, To: s.To})
+		case stepSetRef, stepPushRef:
+			steps = append(steps, &journalStep{Op: stepSetRef, From: s.Undo, To: s.To})
+		}
+	}
+	return steps, cleanup
+}
+
+// Whether path is inside temporary or state directory, which means that
+// it won't be there anymore by the time of rollback
+func isTemporary(path string) bool {
+	for _, dir := range []string{tmpDir, stateDir} {
+		if strings.HasPrefix(filepath.Clean(path), dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
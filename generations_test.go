@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUndoSteps(t *testing.T) {
+	tmpBranch := filepath.Join(tmpDir, "bzr_branch")
+	tests := []struct {
+		name string
+		step journalStep
+		kept string
+		undo journalStep
+	}{
+		{"rename dir",
+			journalStep{Op: stepRenameDir, From: "bzr/old", To: "bzr/new"}, "",
+			journalStep{Op: stepRenameDir, From: "bzr/new", To: "bzr/old"}},
+		{"kept branch",
+			journalStep{Op: stepRenameDir, From: "bzr/old", To: filepath.Join(tmpDir, "trash")}, "bzr-branch-0",
+			journalStep{Op: stepRenameDir, From: filepath.Join(generationDir(3), "bzr-branch-0"), To: "bzr/old"}},
+		{"git branch",
+			journalStep{Op: stepGitBranch, From: "tmp", To: "feature", Undo: "1111"}, "",
+			journalStep{Op: stepSetRef, From: "1111", To: "refs/heads/feature"}},
+		{"new git branch",
+			journalStep{Op: stepGitBranch, From: "tmp", To: "feature"}, "",
+			journalStep{Op: stepSetRef, To: "refs/heads/feature"}},
+		{"bzr pull",
+			journalStep{Op: stepBzrPull, From: tmpBranch, To: "bzr/feature", Undo: "rev-1"}, "",
+			journalStep{Op: stepBzrReset, From: "rev-1", To: "bzr/feature"}},
+		{"bzr reset",
+			journalStep{Op: stepBzrReset, From: "rev-1", To: "bzr/feature", Undo: "rev-2"}, "",
+			journalStep{Op: stepBzrReset, From: "rev-2", To: "bzr/feature"}},
+		{"move ref",
+			journalStep{Op: stepMoveRef, From: "refs/heads/a", To: "refs/removed/a", Undo: "1111"}, "",
+			journalStep{Op: stepMoveRef, From: "refs/removed/a", To: "refs/heads/a"}},
+		{"copy ref",
+			journalStep{Op: stepCopyRef, From: "refs/heads/a", To: "refs/removed/a", Undo: "1111"}, "",
+			journalStep{Op: stepSetRef, To: "refs/removed/a"}},
+		{"set ref",
+			journalStep{Op: stepSetRef, From: "2222", To: notesRef, Undo: "1111"}, "",
+			journalStep{Op: stepSetRef, From: "1111", To: notesRef}},
+		{"push",
+			journalStep{Op: stepPushRef, From: "2222", To: "refs/heads/a", Undo: "1111"}, "",
+			journalStep{Op: stepSetRef, From: "1111", To: "refs/heads/a"}},
+		{"push creating branch",
+			journalStep{Op: stepPushRef, From: "2222", To: "refs/heads/a"}, "",
+			journalStep{Op: stepSetRef, To: "refs/heads/a"}},
+	}
+	for _, tt := range tests {
+		step := tt.step
+		g := &generation{N: 3, Journal: &journal{Steps: []*journalStep{&step}}}
+		if tt.kept != "" {
+			g.Kept = map[int]string{0: tt.kept}
+		}
+		steps, cleanup := g.undoSteps()
+		if len(steps) != 1 || !reflect.DeepEqual(*steps[0], tt.undo) {
+			t.Errorf("%s: got %v, want %v", tt.name, steps, &tt.undo)
+		}
+		if len(cleanup) != 0 {
+			t.Errorf("%s: unexpected cleanup %v", tt.name, cleanup)
+		}
+	}
+
+	// config changes are restored from the saved files
+	for _, op := range []string{stepReplaceFile, stepAddBranch, stepDelBranch, stepSetBranch} {
+		g := &generation{Journal: &journal{Steps: []*journalStep{{Op: op}}}}
+		if steps, _ := g.undoSteps(); len(steps) != 0 {
+			t.Errorf("%s: got %v, want no steps", op, steps)
+		}
+	}
+}
+
+// Branch created from a temporary directory is moved into trash
+func TestUndoTemporaryRename(t *testing.T) {
+	g := &generation{N: 1, Journal: &journal{Steps: []*journalStep{
+		{Op: stepRenameDir, From: filepath.Join(tmpDir, "bzr_branch"), To: "bzr/new"},
+		{Op: stepAddBranch, Branch: &branchInfo{Git: "new"}},
+	}}}
+	steps, cleanup := g.undoSteps()
+	if len(steps) != 1 || len(cleanup) != 1 {
+		t.Fatalf("got %v, cleanup %v", steps, cleanup)
+	}
+	s := steps[0]
+	if s.Op != stepRenameDir || s.From != "bzr/new" || s.To != cleanup[0] || !isTemporary(s.To) {
+		t.Errorf("got %v, cleanup %v", s, cleanup)
+	}
+}
+
+func TestSaveGeneration(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "generations_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bridgeConfigName, []byte(`{"Generations": 3}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		// marks files are always replaced, never changed in place
+		content := []byte(strings.Repeat("x", i))
+		for _, f := range []string{bzrMarks, gitMarks} {
+			if err := writeFileAtomic(f, content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// hidden branch removed by the transaction
+		bzrBranch := filepath.Join(tmpDir, "removed")
+		if err := os.MkdirAll(bzrBranch, 0777); err != nil {
+			t.Fatal(err)
+		}
+		j := &journal{
+			Steps:        []*journalStep{{Op: stepRenameDir, From: "bzr/b", To: bzrBranch}},
+			CleanupFiles: []string{bzrBranch},
+		}
+		gen := beginGeneration()
+		if err := saveGeneration(gen, j); err != nil {
+			t.Fatal(err)
+		}
+		if exists(bzrBranch) {
+			t.Errorf("%d: removed branch wasn't moved into the generation", i)
+		}
+	}
+
+	all, err := generationNumbers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(all, []int{1, 2, 3}) {
+		t.Fatalf("got generations %v, want [1 2 3]", all)
+	}
+	for _, n := range all {
+		g, err := loadGeneration(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.Kept[0] == "" || !exists(filepath.Join(generationDir(n), g.Kept[0])) {
+			t.Errorf("%d: kept branch is missing: %v", n, g.Kept)
+		}
+		// generation n holds marks from before the n-th transaction from the end
+		data, err := ioutil.ReadFile(filepath.Join(generationDir(n), bzrMarks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Repeat("x", 6-n); string(data) != want {
+			t.Errorf("%d: got marks %q, want %q", n, data, want)
+		}
+	}
+}
@@ -4,9 +4,12 @@ import (
 	l "github.com/usovalx/git-bzr-bridge/log"
 
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Config options
@@ -76,15 +79,23 @@ func Import(inMarks, outMarks string) *exec.Cmd {
 	return c
 }
 
-func Export(branch, inMarks, outMarks string) *exec.Cmd {
+// Export branch or revision. For revisions given by object name, fast-export
+// uses the object name instead of the reference name in the stream.
+func Export(rev, inMarks, outMarks string) *exec.Cmd {
 	flags := []string{
 		"fast-export", "-M", "-C",
 		"--import-marks=" + inMarks,
 		"--export-marks=" + outMarks,
-		branch}
+		rev}
 	return git(flags...)
 }
 
+// Whether we are running from the pre-receive hook, where pushed objects are
+// quarantined and git refuses to update any references
+func InQuarantine() bool {
+	return os.Getenv("GIT_QUARANTINE_PATH") != ""
+}
+
 func RenameBranch(from, to string) error {
 	return run(git("branch", "-M", from, to))
 }
@@ -97,6 +108,224 @@ func NewBranch(name, rev string) error {
 	return run(git("branch", name, rev))
 }
 
+// Resolve reference into object name. Returns empty string
+// if reference doesn't exist
+func ResolveRef(ref string) (string, error) {
+	out, err := git("rev-parse", "--verify", "-q", ref).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// All values of the config variable, nil if it isn't set
+func ConfigValues(key string) ([]string, error) {
+	out, err := git("config", "--get-all", key).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), nil
+}
+
+func UpdateRef(ref, rev string) error {
+	return run(git("update-ref", ref, rev))
+}
+
+func DeleteRef(ref string) error {
+	return run(git("update-ref", "-d", ref))
+}
+
+// Create annotated tag object pointing to the commit and return its name
+func MkTag(name, commit, tagger, message string) (string, error) {
+	c := git("mktag")
+	c.Stdin = strings.NewReader(fmt.Sprintf(
+		"object %s\ntype commit\ntag %s\ntagger %s %d +0000\n\n%s\n",
+		commit, name, tagger, time.Now().Unix(), message))
+	out, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s mktag: %s", c.Path, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Check whether name is a valid reference name
+func CheckRefFormat(name string) bool {
+	return git("check-ref-format", name).Run() == nil
+}
+
+// Check whether commit a is an ancestor of commit b
+func IsAncestor(a, b string) (bool, error) {
+	err := git("merge-base", "--is-ancestor", a, b).Run()
+	if err == nil {
+		return true, nil
+	}
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, err
+}
+
+// Path of the file inside of git directory, see git rev-parse --git-path
+func GitPath(name string) (string, error) {
+	out, err := git("rev-parse", "--git-path", name).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Find types of the objects, missing objects get "missing" type
+func ObjectTypes(objects []string) (map[string]string, error) {
+	c := git("cat-file", "--batch-check=%(objectname) %(objecttype)")
+	c.Stdin = strings.NewReader(strings.Join(objects, "\n") + "\n")
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s cat-file: %s", c.Path, err)
+	}
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		s := strings.Fields(line)
+		if len(s) == 2 {
+			res[s[0]] = s[1]
+		}
+	}
+	return res, nil
+}
+
+// Read note attached to the object, returns empty string if there is none
+func Note(ref, object string) (string, error) {
+	c := git("notes", "--ref="+ref, "show", object)
+	c.Stderr = nil // complains if there is no note
+	out, err := c.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// Read all notes under the notes reference, returns a map
+// from annotated object to the text of its note
+func Notes(ref string) (map[string]string, error) {
+	c := git("notes", "--ref="+ref, "list")
+	c.Stderr = nil
+	out, err := c.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 1 {
+			return nil, nil // no notes at all
+		}
+		return nil, err
+	}
+	var blobs, objects []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if s := strings.Fields(line); len(s) == 2 {
+			blobs = append(blobs, s[0])
+			objects = append(objects, s[1])
+		}
+	}
+	if len(blobs) == 0 {
+		return nil, nil
+	}
+
+	c = git("cat-file", "--batch")
+	c.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	out, err = c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s cat-file: %s", c.Path, err)
+	}
+	notes := make(map[string]string)
+	for i := range blobs {
+		// <name> <type> <size> LF <contents> LF
+		nl := strings.IndexByte(string(out), '\n')
+		s := strings.Fields(string(out[:nl+1]))
+		if nl < 0 || len(s) != 3 {
+			return nil, fmt.Errorf("git cat-file: unexpected output")
+		}
+		size, err := strconv.Atoi(s[2])
+		if err != nil || nl+1+size+1 > len(out) {
+			return nil, fmt.Errorf("git cat-file: unexpected output")
+		}
+		notes[objects[i]] = string(out[nl+1 : nl+1+size])
+		out = out[nl+1+size+1:]
+	}
+	return notes, nil
+}
+
+// Metadata of the commit used to find it in the other repository
+type CommitInfo struct {
+	Commit, Tree           string
+	Author, Committer      string // "Name <email>"
+	AuthorTime, CommitTime string
+	Message                string
+}
+
+// Read metadata of all commits reachable from any reference except notes
+func AllCommits() ([]*CommitInfo, error) {
+	out, err := git("log", "--exclude=refs/notes/*", "--all",
+		"--format=%H%x00%T%x00%an <%ae>%x00%at%x00%cn <%ce>%x00%ct%x00%B%x00").Output()
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Split(string(out), "\x00")
+	var res []*CommitInfo
+	for i := 0; i+7 <= len(f); i += 7 {
+		res = append(res, &CommitInfo{
+			Commit:     strings.TrimSpace(f[i]),
+			Tree:       f[i+1],
+			Author:     f[i+2],
+			AuthorTime: f[i+3],
+			Committer:  f[i+4],
+			CommitTime: f[i+5],
+			Message:    f[i+6],
+		})
+	}
+	return res, nil
+}
+
+// Find trees of the commits
+func CommitTrees(commits []string) (map[string]string, error) {
+	c := git("log", "--no-walk=unsorted", "--stdin", "--format=%H %T")
+	c.Stdin = strings.NewReader(strings.Join(commits, "\n") + "\n")
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s log: %s", c.Path, err)
+	}
+	res := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		s := strings.Fields(line)
+		if len(s) == 2 {
+			res[s[0]] = s[1]
+		}
+	}
+	return res, nil
+}
+
+// Feed fast-import stream into git without any marks files
+func FastImport(stream io.Reader) error {
+	c := git("fast-import", "--quiet")
+	c.Stdin = stream
+	return run(c)
+}
+
+// Commits reachable from revs which aren't reachable from any reference.
+// In the pre-receive hook these are the commits being pushed.
+func NewCommits(revs []string) ([]string, error) {
+	args := append([]string{"rev-list"}, revs...)
+	out, err := git(append(args, "--not", "--all")...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
 func LeftRevList(old, new string) ([]byte, error) {
 	return git("rev-list", "--left-only", old+"..."+new).Output()
 }
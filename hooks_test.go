@@ -0,0 +1,143 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Hooks installed by the tests call the test binary, which runs main
+// instead of the tests if this variable is set
+const testMainEnv = "GIT_BZR_BRIDGE_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testMainEnv) != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// Just enough of bzr to export pushes: all branches are at rev-1, fast-import
+// gives revision rev-<n> to mark n and push and pull do nothing
+const fakeBzr = `#!/bin/sh
+case "$1" in
+revision-info)
+	if [ $# -eq 3 ]; then
+		echo "1 rev-1"
+		exit 0
+	fi
+	shift 3
+	n=1
+	for r; do
+		echo "$n ${r#revid:}"
+		n=$((n+1))
+	done
+	;;
+fast-import)
+	# fast-import --import-marks <in> --export-marks <out> - <repo>
+	cat >"$5.stream"
+	cp "$3" "$5"
+	sed -n 's/^mark :\([0-9]*\)$/:\1 rev-\1/p' "$5.stream" >>"$5"
+	for ref in $(sed -n 's/^commit refs\/heads\///p' "$5.stream"); do
+		mkdir -p "$7/$ref"
+	done
+	rm "$5.stream"
+	;;
+esac
+`
+
+// Push into a real repo goes through pre-receive hook, which runs in
+// the quarantine environment where references can't be changed,
+// and post-receive hook
+func TestPreReceiveHook(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't available")
+	}
+	feature := &branchInfo{Url: "lp:feature", Bzr: filepath.Join(bzrRepo, "feature"), Git: "feature"}
+	tip := setupBridge(t, feature)
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// second branch, which will be deleted by the push
+	old := &branchInfo{Url: "lp:old", Bzr: filepath.Join(bzrRepo, "old"), Git: "old", OnDelete: deleteArchive}
+	if err := git.UpdateRef("refs/heads/old", tip); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal([]*branchInfo{feature, old})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(branchConfigName, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bridgeConfigName, []byte(`{"Notes": true}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "bzr"), []byte(fakeBzr), 0777); err != nil {
+		t.Fatal(err)
+	}
+	installHooks(hookOptions{preReceive: true})
+
+	client := filepath.Join(dir, tmpDir, "client")
+	gitClient := func(args ...string) string {
+		args = append([]string{"-C", client, "-c", "user.name=A", "-c", "user.email=a@example.com"}, args...)
+		c := exec.Command("git", args...)
+		c.Env = append(os.Environ(),
+			testMainEnv+"=1",
+			"PATH="+filepath.Join(dir, tmpDir)+string(os.PathListSeparator)+os.Getenv("PATH"))
+		out, err := c.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %s\n%s", strings.Join(args[6:], " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if out, err := exec.Command("git", "clone", "-q", "-b", "feature", dir, client).CombinedOutput(); err != nil {
+		t.Fatalf("git clone: %s\n%s", err, out)
+	}
+	gitClient("commit", "-q", "--allow-empty", "-m", "new")
+	newTip := gitClient("rev-parse", "HEAD")
+	gitClient("push", "-q", "origin", "feature", ":old")
+
+	if rev, _ := git.ResolveRef("refs/heads/feature"); rev != newTip {
+		t.Errorf("feature wasn't updated: %s", rev)
+	}
+	if rev, _ := git.ResolveRef("refs/heads/old"); rev != "" {
+		t.Error("old wasn't deleted")
+	}
+	out, err := exec.Command("git", "for-each-ref", "--format=%(objectname)", removedRefsPrefix).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(out)) != tip {
+		t.Errorf("commits of the deleted branch weren't kept: %q", out)
+	}
+	c, err := loadBranchConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := c.byGitName["old"]; b == nil || !b.Frozen {
+		t.Errorf("old isn't archived: %+v", b)
+	}
+
+	note, err := git.Note(notesRef, newTip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revid, _, branch := parseBzrNote(note); !strings.HasPrefix(revid, "rev-") || branch != "feature" {
+		t.Errorf("wrong note of the pushed commit: %q", note)
+	}
+	if exists(pendingNotesName) {
+		t.Error("pending notes weren't removed")
+	}
+	if refs, _ := exec.Command("git", "for-each-ref", "refs/heads/__git_import").Output(); len(refs) != 0 {
+		t.Errorf("temporary branches are left: %s", refs)
+	}
+}
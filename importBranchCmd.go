@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/usovalx/git-bzr-bridge/bzr"
 	"github.com/usovalx/git-bzr-bridge/git"
+	"github.com/usovalx/git-bzr-bridge/markindex"
 
 	"flag"
 	"fmt"
@@ -17,6 +18,9 @@ func importCmd(args []string) {
 	fs := flag.NewFlagSet("import", flag.ExitOnError)
 	help := fs.Bool("h", false, "show usage message")
 	b := fs.String("b", "", "git branch name")
+	mode := fs.String("mode", modeBidirectional, "direction of synchronization: bidirectional, mirror or push")
+	tags := fs.String("tags", "", "import bzr tags as lightweight or annotated git tags")
+	tagNamespace := fs.String("tag-namespace", "", "prefix of git tag references (default "+defaultTagNamespace+")")
 	fs.Usage = func() { importUsage(fs) }
 	fs.Parse(args)
 
@@ -40,6 +44,9 @@ func importCmd(args []string) {
 		gitBranch = fs.Arg(1)
 	}
 
+	lk := lockBranch(gitBranch)
+	defer lk.Release()
+
 	// load branch config and check that new branch names don't clash
 	c, err := loadBranchConfig()
 	must(err)
@@ -47,9 +54,25 @@ func importCmd(args []string) {
 		log.Error("Requested branch names clash with existing ones")
 		os.Exit(1)
 	}
+	branch := &branchInfo{Url: url, Bzr: bzrBranch, Git: gitBranch}
+	switch *mode {
+	case modeBidirectional:
+	case modeMirror, modePush:
+		branch.Mode = *mode
+	default:
+		log.Errorf("Invalid mode %q", *mode)
+		os.Exit(1)
+	}
+	if *tags != "" {
+		branch.Tags = &tagsInfo{Kind: *tags, Namespace: *tagNamespace}
+		if err := branch.Tags.validate(); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
 
 	cloneAndExportBzrImportGit(
-		url,
+		url, "", gitBranch,
 		func(_ string) bool { return true },
 		func(marksUpdated bool, tmpGitMarks, tmpBzrMarks, tmpGitBranch, tmpBzrBranch string) {
 			// finilize transaction
@@ -57,28 +80,40 @@ func importCmd(args []string) {
 			// while we can live with stale temporary branches and/or files
 			// and easily clean them up manually later it is extremely
 			// important that we keep marks files in sync.
-			must(os.MkdirAll(filepath.Dir(bzrBranch), 0777))
-			must(os.Rename(tmpBzrBranch, bzrBranch))
-			must(git.RenameBranch(tmpGitBranch, gitBranch))
-			must(addBranchToConfig(url, bzrBranch, gitBranch))
+			tags := fetchBzrTags(branch, tmpBzrBranch)
+			j := &journal{
+				Steps: []*journalStep{
+					{Op: stepRenameDir, From: tmpBzrBranch, To: bzrBranch},
+					{Op: stepGitBranch, From: tmpGitBranch, To: gitBranch},
+					{Op: stepAddBranch, Branch: branch},
+				},
+				CleanupFiles:    []string{tmpGitMarks, tmpBzrMarks, tmpBzrBranch},
+				CleanupBranches: []string{tmpGitBranch},
+			}
 			// no need to update marks if no new revisions were exported
 			if marksUpdated {
-				must(os.Rename(tmpBzrMarks, bzrMarks))
-				must(os.Rename(tmpGitMarks, gitMarks))
+				j.Steps = append(j.Steps, marksSteps(tmpGitMarks, tmpBzrMarks)...)
+				if s := notesStep(tmpGitMarks, tmpBzrMarks, tmpBzrBranch, gitBranch); s != nil {
+					j.Steps = append(j.Steps, s)
+				}
 			}
+			runJournal(j)
+			importBzrTags(branch, tags)
 		})
 }
 
+// Fetch bzr branch from url and import it into git. If base isn't empty,
+// it should be an existing bzr branch which will be used as a starting point,
+// so that only new revisions will be fetched from url. gitBranch is only used
+// to name the archived stream.
 func cloneAndExportBzrImportGit(
-	url string,
+	url, base, gitBranch string,
 	shouldExport func(tmpBzrBranch string) bool,
 	finalizer func(marksUpdated bool, tmpGitMarks, tmpBzrMarks, tmpGitBranch, tmpBzrBranch string)) bool {
 
 	tmpGitBranch := tempBranchName()
 	tmpBzrBranch := filepath.FromSlash(path.Join(bzrRepo, tmpGitBranch))
 
-	// FIXME: use locks
-
 	// Create all temporary files we will use later
 	tmpBzrMarks, err := ioutil.TempFile(tmpDir, "bzr_marks")
 	must(err)
@@ -89,14 +124,23 @@ func cloneAndExportBzrImportGit(
 	defer os.Remove(tmpGitMarks.Name())
 	tmpGitMarks.Close()
 
-	log.Info("Cloning bzr branch")
 	defer os.RemoveAll(tmpBzrBranch)
-	must(bzr.Clone(url, tmpBzrBranch))
+	if base == "" {
+		log.Info("Cloning bzr branch")
+		must(bzr.Clone(url, tmpBzrBranch))
+	} else {
+		log.Info("Fetching new revisions from bzr")
+		must(fetchBzrBranch(url, base, tmpBzrBranch))
+	}
 
 	if !shouldExport(tmpBzrBranch) {
 		return false
 	}
 
+	// everything from here on reads and updates shared marks files
+	lk := lockRepo()
+	defer lk.Release()
+
 	log.Info("Exporting data from bzr")
 	defer func() {
 		if e := recover(); e != nil {
@@ -104,9 +148,13 @@ func cloneAndExportBzrImportGit(
 			panic(e)
 		}
 	}()
+	archive := newStreamArchive(gitBranch, false)
 	exportSize, err := RunPipe(
 		bzr.Export(tmpBzrBranch, tmpGitBranch, bzrMarks, tmpBzrMarks.Name()),
-		git.Import(gitMarks, tmpGitMarks.Name()))
+		git.Import(gitMarks, tmpGitMarks.Name()),
+		archive.writer(),
+		streamFilters(false)...)
+	archive.finish(exportSize)
 	must(err)
 
 	// if all revisions of the branch are already in the repo,
@@ -116,15 +164,13 @@ func cloneAndExportBzrImportGit(
 		log.Info("Empty export. Creating git branch using marks")
 		rev, err := bzr.Tip(tmpBzrBranch)
 		must(err)
-		b, err := loadMarks(bzrMarks)
-		must(err)
-		g, err := loadMarks(gitMarks)
-		must(err)
-		mark, ok := b.byRev[rev]
+		mi := openMarksIndex()
+		defer mi.Close()
+		mark, ok := markOf(mi.bzr, rev)
 		if !ok {
 			log.Panicf("Can't find revision %q in the bzr marks file", rev)
 		}
-		grev, ok := g.byMark[mark]
+		grev, ok := revOf(mi.git, mark)
 		if !ok {
 			log.Panicf("Can't find mark %d in git marks file", mark)
 		}
@@ -136,8 +182,46 @@ func cloneAndExportBzrImportGit(
 	return true
 }
 
+// Create a staging copy of base branch and pull new revisions from url
+// into it. Falls back to full clone if upstream history was rewritten.
+func fetchBzrBranch(url, base, branch string) error {
+	// it's a cheap local operation -- all revisions are in the shared repo
+	if err := bzr.Clone(base, branch); err != nil {
+		return err
+	}
+	err := bzr.Pull(url, branch)
+	if err != bzr.ErrDiverged {
+		return err
+	}
+
+	log.Info("Upstream history was rewritten, cloning bzr branch")
+	if err := os.RemoveAll(branch); err != nil {
+		return err
+	}
+	return bzr.Clone(url, branch)
+}
+
+// Journal steps replacing both marks files with their new versions, together
+// with their indexes. Caller must hold repository lock.
+func marksSteps(tmpGitMarks, tmpBzrMarks string) []*journalStep {
+	steps := []*journalStep{
+		{Op: stepReplaceFile, From: tmpBzrMarks, To: bzrMarks},
+		{Op: stepReplaceFile, From: tmpGitMarks, To: gitMarks},
+	}
+	// index is only a cache, it will be rebuilt on the next lookup if it's missing
+	for _, m := range [][2]string{{tmpBzrMarks, bzrMarks}, {tmpGitMarks, gitMarks}} {
+		if err := markindex.Update(m[0], m[1]); err != nil {
+			log.Errorf("Can't update index of %s: %s", m[1], err)
+			continue
+		}
+		steps = append(steps, &journalStep{Op: stepReplaceFile,
+			From: m[0] + markindex.IndexSuffix, To: m[1] + markindex.IndexSuffix})
+	}
+	return steps
+}
+
 func importUsage(fs *flag.FlagSet) {
-	fmt.Println("usage: git-bzr-bridge import [-h] [-g <branch>] <url> <bzr branch>")
+	fmt.Println("usage: git-bzr-bridge import [-h] [-g <branch>] [-mode <mode>] [-tags <kind>] [-tag-namespace <prefix>] <url> <bzr branch>")
 	fmt.Println("\nflags:")
 	fs.SetOutput(os.Stdout)
 	fs.PrintDefaults()
@@ -146,5 +230,16 @@ func importUsage(fs *flag.FlagSet) {
 import will clone bzr branch from <url> and save it as <bzr branch> in
 the internal bzr repo. Then it will import the branch into git as <branch>.
 If <branch> isn't specified, it is assumed to be the same as <bzr branch>
+
+-mode sets direction of synchronization: "bidirectional" (default), "mirror"
+for read-only mirrors of bzr branches rejecting pushes from git, or "push" for
+branches where git is authoritative and which aren't updated from bzr.
+
+If -tags is given, bzr tags of the branch will be imported as git tags of the
+given <kind> (lightweight or annotated). Tags are created under refs/tags/
+unless another <prefix> is specified, {branch} in the <prefix> is replaced
+with the name of git branch (e.g. refs/tags/bzr/{branch}/). Tags pointing to
+revisions which aren't imported and tags which already exist in git with
+a different value are skipped.
 `)
 }
@@ -14,6 +14,7 @@ func initCmd(args []string) {
 	// command-line flags
 	fs := flag.NewFlagSet("init", flag.ExitOnError)
 	help := fs.Bool("h", false, "show usage message")
+	hooks := fs.Bool("hooks", false, "install git hooks (see install-hooks)")
 	fs.Usage = func() { initUsage(fs) }
 	fs.Parse(args)
 
@@ -34,6 +35,10 @@ func initCmd(args []string) {
 	os.Mkdir(repoPath, 0777)
 	must(os.Chdir(repoPath))
 
+	// guard against concurrent init of the same directory
+	lk := lockRepo()
+	defer lk.Release()
+
 	// first try to initialize bzr repo, so that it will fail early in case of any issues
 	log.Debug("Initializing bzr repo")
 	must(bzr.InitRepo(bzrRepo))
@@ -46,15 +51,34 @@ func initCmd(args []string) {
 	must(ioutil.WriteFile(gitMarks, []byte{}, 0666))
 	log.Debug("Creating temp dir")
 	must(os.Mkdir(tmpDir, 0777))
+	if *hooks {
+		installHooks(hookOptions{})
+	}
 }
 
 func initUsage(fs *flag.FlagSet) {
-	fmt.Println("usage: git-bzr-bridge init [-h] <path>")
+	fmt.Println("usage: git-bzr-bridge init [-h] [-hooks] <path>")
 	fmt.Println("\nflags:")
 	fs.SetOutput(os.Stdout)
 	fs.PrintDefaults()
 
 	fmt.Print(`
-init will initialize a new repository at <path>
+init will initialize a new repository at <path>. With -hooks it will
+also install git hooks calling git-bzr-bridge update-hook.
+
+Identities of bzr committers can be translated into git identities (and back
+when pushing) with ` + authorsMapName + ` in the bridge directory.
+The map applies to all branches of the bridge, each line of it maps one
+identity, e.g.:
+  Jane Doe <jane@host.localdomain> = Jane Doe <jane@example.com>
+  jdoe = Jane Doe <jane@example.com>
+The map only applies to revisions imported or pushed after it was changed.
+
+Known defects of fast-export streams (empty commit messages, deletes of paths
+removed earlier in the same commit, renames in the wrong order) are repaired
+on the fly in both directions, for imports, updates and pushes of all
+branches. Deletes of paths which are missing from the parent commit aren't
+detected, as the stream doesn't carry the parent tree. Set StrictStreams in
+` + bridgeConfigName + ` to fail on them instead.
 `)
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Marker identifying hooks generated by git-bzr-bridge
+const hookMarker = "# git-bzr-bridge hook"
+
+// Suffix of the foreign hooks which are called from our hooks
+const chainedSuffix = ".chained"
+
+type hookOptions struct {
+	preReceive bool // use pre-receive hook instead of update hook
+	chain      bool // keep existing foreign hooks and call them first
+	force      bool // overwrite existing foreign hooks
+}
+
+func installHooksCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("install-hooks", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	var opts hookOptions
+	fs.BoolVar(&opts.preReceive, "pre-receive", false, "use pre-receive hook instead of update hook")
+	fs.BoolVar(&opts.chain, "chain", false, "call existing hooks before git-bzr-bridge")
+	fs.BoolVar(&opts.force, "force", false, "overwrite existing hooks")
+	fs.Usage = func() { installHooksUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 || (opts.chain && opts.force) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	installHooks(opts)
+}
+
+// Install git hooks calling git-bzr-bridge for the repo in current directory
+func installHooks(opts hookOptions) {
+	bin, err := os.Executable()
+	must(err)
+	bin, err = filepath.EvalSymlinks(bin)
+	must(err)
+	dir, err := os.Getwd()
+	must(err)
+	hooksDir, err := git.GitPath("hooks")
+	must(err)
+	must(os.MkdirAll(hooksDir, 0777))
+
+	bridgeConfig, err := loadBridgeConfig()
+	must(err)
+
+	hook, other := "update", "pre-receive"
+	if opts.preReceive {
+		hook, other = other, hook
+	}
+	// only one of them should call us, otherwise everything is exported twice
+	must(uninstallHook(filepath.Join(hooksDir, other)))
+
+	cmd := fmt.Sprintf("%s -C %s", shellQuote(bin), shellQuote(dir))
+	must(installHook(filepath.Join(hooksDir, hook), cmd+" "+hook+"-hook", opts))
+	if bridgeConfig.Async || opts.preReceive {
+		must(installHook(filepath.Join(hooksDir, "post-receive"), cmd+" post-receive-hook", opts))
+	} else {
+		must(uninstallHook(filepath.Join(hooksDir, "post-receive")))
+	}
+
+	if bridgeConfig.Notes {
+		must(checkNotesVisible())
+		log.Infof("Clients can fetch bzr notes with: git config --add remote.origin.fetch %s", notesFetchRefspec)
+	}
+}
+
+// Refspec clients should add to their remote to fetch the notes
+const notesFetchRefspec = "+" + notesRef + ":" + notesRef
+
+// Check that notes reference isn't hidden from the clients
+func checkNotesVisible() error {
+	for _, key := range []string{"transfer.hideRefs", "uploadpack.hideRefs"} {
+		values, err := git.ConfigValues(key)
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			if v != "" && v[0] != '!' && (v == notesRef || strings.HasPrefix(notesRef, strings.TrimSuffix(v, "/")+"/")) {
+				return fmt.Errorf("%s is hidden from the clients by %s = %s", notesRef, key, v)
+			}
+		}
+	}
+	return nil
+}
+
+func installHook(path, cmd string, opts hookOptions) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && !bytes.Contains(data, []byte(hookMarker)) {
+		switch {
+		case opts.chain:
+			if exists(path + chainedSuffix) {
+				return fmt.Errorf("%s already exists", path+chainedSuffix)
+			}
+			log.Infof("Moving existing hook to %s", path+chainedSuffix)
+			if err := os.Rename(path, path+chainedSuffix); err != nil {
+				return err
+			}
+		case opts.force:
+			log.Infof("Overwriting existing hook %s", path)
+		default:
+			return fmt.Errorf("%s already exists, use -chain or -force", path)
+		}
+	}
+
+	log.Infof("Installing %s", path)
+	return ioutil.WriteFile(path, []byte(hookScript(filepath.Base(path), cmd, exists(path+chainedSuffix))), 0777)
+}
+
+// Remove our hook, putting chained hook back in place
+func uninstallHook(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(data, []byte(hookMarker)) {
+		return nil
+	}
+
+	log.Infof("Removing %s", path)
+	if exists(path + chainedSuffix) {
+		return os.Rename(path+chainedSuffix, path)
+	}
+	return os.Remove(path)
+}
+
+func hookScript(name, cmd string, chained bool) string {
+	s := "#!/bin/sh\n" + hookMarker + ", generated by 'git-bzr-bridge install-hooks'\n"
+	next := `"$0` + chainedSuffix + `"`
+	switch {
+	case !chained:
+		s += "exec " + cmd + ` "$@"` + "\n"
+	case name == "update":
+		s += next + ` "$@" || exit $?` + "\n"
+		s += "exec " + cmd + ` "$@"` + "\n"
+	case name == "post-receive":
+		// result of post-receive doesn't matter, always run both
+		s += "input=$(cat)\n"
+		s += `printf '%s\n' "$input" | ` + next + "\n"
+		s += `printf '%s\n' "$input" | ` + cmd + "\n"
+	default:
+		// hooks reading list of references from stdin
+		s += "input=$(cat)\n"
+		s += `printf '%s\n' "$input" | ` + next + ` || exit $?` + "\n"
+		s += `printf '%s\n' "$input" | ` + cmd + "\n"
+	}
+	return s
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func installHooksUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge install-hooks [-h] [-pre-receive] [-chain | -force]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+install-hooks will install git hooks which call git-bzr-bridge for every push.
+By default it installs update hook, or pre-receive hook if -pre-receive is
+given. If asynchronous mode is enabled in ` + bridgeConfigName + ` or -pre-receive
+is given, it will also install post-receive hook.
+
+Existing hooks which weren't generated by git-bzr-bridge are left alone unless
+-force is given. With -chain they are kept as <hook>` + chainedSuffix + ` and called
+before git-bzr-bridge.
+
+If Notes is set in ` + bridgeConfigName + `, install-hooks also checks that
+` + notesRef + ` isn't hidden by transfer.hideRefs or uploadpack.hideRefs.
+Git doesn't fetch notes by default, so clients need to add the refspec once:
+
+    git config --add remote.origin.fetch ` + notesFetchRefspec + `
+`)
+}
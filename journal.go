@@ -0,0 +1,494 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Finalisation of imports and pushes consists of several steps (renaming
+// marks files, moving branches, updating config) which must either all
+// happen or not happen at all. Before doing anything the steps are written
+// into the journal together with the information required to undo them,
+// and progress is recorded after each step. If the process dies half-way,
+// next run will find the journal and either finish the transaction
+// or roll it back.
+
+var journalName = filepath.Join(tmpDir, "journal")
+
+// Step kinds
+const (
+	stepReplaceFile = "replace-file" // rename From over To
+	stepRenameDir   = "rename-dir"   // rename From into To, To must not exist
+	stepGitBranch   = "git-branch"   // rename git branch From into To
+	stepBzrPull     = "bzr-pull"     // pull --overwrite From into To
+	stepAddBranch   = "add-branch"   // add Branch into branch config
+	stepDelBranch   = "del-branch"   // remove Branch from branch config
+	stepSetBranch   = "set-branch"   // replace Prev with Branch in branch config
+	stepMoveRef     = "move-ref"     // move git reference From into To, To must not exist
+	stepCopyRef     = "copy-ref"     // copy git reference From into To, To must not exist
+	stepSetRef      = "set-ref"      // point git reference To at object From, delete it if From is empty
+	stepBzrReset    = "bzr-reset"    // move tip of bzr branch To to revision From
+	stepPushRef     = "push-ref"     // git reference To is moved to From by the push itself, Undo is its old value
+)
+
+type journalStep struct {
+	Op       string
+	From, To string      `json:",omitempty"`
+	Branch   *branchInfo `json:",omitempty"`
+	// state captured before the step was applied, used for rollback
+	Undo string      `json:",omitempty"`
+	Prev *branchInfo `json:",omitempty"`
+}
+
+type journal struct {
+	Steps []*journalStep
+	// number of steps which were already applied
+	Done int
+	// temporary files, directories and git branches which should be
+	// removed once transaction is finished one way or another
+	CleanupFiles    []string `json:",omitempty"`
+	CleanupBranches []string `json:",omitempty"`
+}
+
+func (s *journalStep) String() string {
+	switch s.Op {
+	case stepAddBranch, stepDelBranch:
+		return fmt.Sprintf("%s %s (%s)", s.Op, s.Branch.Git, s.Branch.Url)
+	case stepSetBranch:
+		return fmt.Sprintf("%s %s (%s) -> %s (%s)", s.Op, s.Prev.Git, s.Prev.Url, s.Branch.Git, s.Branch.Url)
+	default:
+		return fmt.Sprintf("%s %s -> %s", s.Op, s.From, s.To)
+	}
+}
+
+func backupName(i int) string {
+	return filepath.Join(tmpDir, fmt.Sprintf("journal-backup-%d", i))
+}
+
+// Capture everything needed to undo the step later
+func (s *journalStep) prepare(i int) error {
+	switch s.Op {
+	case stepReplaceFile:
+		backup := backupName(i)
+		os.Remove(backup)
+		if err := os.Link(s.To, backup); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		s.Undo = backup
+	case stepRenameDir:
+		if _, err := os.Stat(s.To); err == nil {
+			return fmt.Errorf("%s already exists", s.To)
+		}
+	case stepGitBranch:
+		rev, err := git.ResolveRef("refs/heads/" + s.To)
+		if err != nil {
+			return err
+		}
+		s.Undo = rev
+	case stepBzrPull, stepBzrReset:
+		rev, err := bzr.Tip(s.To)
+		if err != nil {
+			return err
+		}
+		s.Undo = rev
+	case stepMoveRef, stepCopyRef:
+		rev, err := git.ResolveRef(s.From)
+		if err != nil {
+			return err
+		}
+		if rev == "" {
+			return fmt.Errorf("git reference %s doesn't exist", s.From)
+		}
+		s.Undo = rev
+	case stepSetRef:
+		rev, err := git.ResolveRef(s.To)
+		if err != nil {
+			return err
+		}
+		s.Undo = rev
+	case stepSetBranch:
+		if s.Prev == nil {
+			return fmt.Errorf("%s: previous branch config is missing", s.Op)
+		}
+	case stepAddBranch, stepDelBranch, stepPushRef:
+	default:
+		return fmt.Errorf("unknown journal step %q", s.Op)
+	}
+	return nil
+}
+
+// Check whether the step can be (re-)applied. Step which was in progress
+// when transaction was interrupted could have been already applied.
+func (s *journalStep) canApply(inProgress bool) error {
+	switch s.Op {
+	case stepReplaceFile:
+		if exists(s.From) || (inProgress && s.replaced()) {
+			return nil
+		}
+		return fmt.Errorf("%s is missing", s.From)
+	case stepRenameDir:
+		if exists(s.From) || (inProgress && exists(s.To)) {
+			return nil
+		}
+		return fmt.Errorf("%s is missing", s.From)
+	case stepGitBranch:
+		from, err := git.ResolveRef("refs/heads/" + s.From)
+		if err != nil {
+			return err
+		}
+		to, err := git.ResolveRef("refs/heads/" + s.To)
+		if err != nil {
+			return err
+		}
+		if from != "" || (inProgress && to != "") {
+			return nil
+		}
+		return fmt.Errorf("git branch %s is missing", s.From)
+	case stepMoveRef:
+		from, err := git.ResolveRef(s.From)
+		if err != nil {
+			return err
+		}
+		if from != "" || inProgress {
+			return nil
+		}
+		return fmt.Errorf("git reference %s is missing", s.From)
+	case stepBzrPull:
+		if !exists(s.From) {
+			return fmt.Errorf("%s is missing", s.From)
+		}
+	case stepBzrReset:
+		if !exists(s.To) {
+			return fmt.Errorf("%s is missing", s.To)
+		}
+	}
+	return nil
+}
+
+// Whether To was already replaced by a new file. Backup taken in prepare()
+// is a hard link to the original file, so we just need to compare them.
+func (s *journalStep) replaced() bool {
+	if s.Undo == "" {
+		return exists(s.To)
+	}
+	a, err := os.Stat(s.To)
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(s.Undo)
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(a, b)
+}
+
+func (s *journalStep) apply() error {
+	switch s.Op {
+	case stepReplaceFile:
+		if !exists(s.From) && s.replaced() {
+			return nil
+		}
+		return os.Rename(s.From, s.To)
+	case stepRenameDir:
+		if !exists(s.From) && exists(s.To) {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(s.To), 0777); err != nil {
+			return err
+		}
+		return os.Rename(s.From, s.To)
+	case stepGitBranch:
+		if rev, err := git.ResolveRef("refs/heads/" + s.From); err != nil {
+			return err
+		} else if rev == "" {
+			return nil
+		}
+		return git.RenameBranch(s.From, s.To)
+	case stepBzrPull:
+		return bzr.PullOverwrite(s.From, s.To)
+	case stepBzrReset:
+		return bzr.ResetTip(s.To, s.From)
+	case stepMoveRef:
+		if err := git.UpdateRef(s.To, s.Undo); err != nil {
+			return err
+		}
+		return git.DeleteRef(s.From)
+	case stepCopyRef:
+		return git.UpdateRef(s.To, s.Undo)
+	case stepSetRef:
+		if s.From == "" {
+			return git.DeleteRef(s.To)
+		}
+		return git.UpdateRef(s.To, s.From)
+	case stepPushRef:
+		// git updates the reference itself, the step is only recorded for rollback command
+		return nil
+	case stepAddBranch:
+		c, err := loadBranchConfig()
+		if err != nil {
+			return err
+		}
+		if _, ok := c.byGitName[s.Branch.Git]; ok {
+			return nil
+		}
+		return addBranchToConfig(s.Branch)
+	case stepDelBranch:
+		return removeBranchFromConfig(s.Branch.Git)
+	case stepSetBranch:
+		return setBranchConfig(s.Prev, s.Branch)
+	}
+	return fmt.Errorf("unknown journal step %q", s.Op)
+}
+
+func (s *journalStep) rollback() error {
+	switch s.Op {
+	case stepReplaceFile:
+		if s.Undo == "" {
+			if err := os.Remove(s.To); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		return os.Rename(s.Undo, s.To)
+	case stepRenameDir:
+		if exists(s.From) {
+			return os.RemoveAll(s.To)
+		}
+		return os.Rename(s.To, s.From)
+	case stepGitBranch:
+		// bring back original branch, it might be a permanent one
+		from, err := git.ResolveRef("refs/heads/" + s.From)
+		if err != nil {
+			return err
+		}
+		to, err := git.ResolveRef("refs/heads/" + s.To)
+		if err != nil {
+			return err
+		}
+		if from == "" && to != "" {
+			if err := git.UpdateRef("refs/heads/"+s.From, to); err != nil {
+				return err
+			}
+		}
+		if s.Undo == "" {
+			return git.DeleteRef("refs/heads/" + s.To)
+		}
+		return git.UpdateRef("refs/heads/"+s.To, s.Undo)
+	case stepBzrPull, stepBzrReset:
+		return bzr.ResetTip(s.To, s.Undo)
+	case stepMoveRef:
+		if err := git.UpdateRef(s.From, s.Undo); err != nil {
+			return err
+		}
+		return git.DeleteRef(s.To)
+	case stepCopyRef:
+		return git.DeleteRef(s.To)
+	case stepSetRef:
+		if s.Undo == "" {
+			return git.DeleteRef(s.To)
+		}
+		return git.UpdateRef(s.To, s.Undo)
+	case stepPushRef:
+		// reference is owned by git
+		return nil
+	case stepAddBranch:
+		return removeBranchFromConfig(s.Branch.Git)
+	case stepDelBranch:
+		c, err := loadBranchConfig()
+		if err != nil {
+			return err
+		}
+		if _, ok := c.byGitName[s.Branch.Git]; ok {
+			return nil
+		}
+		return addBranchToConfig(s.Branch)
+	case stepSetBranch:
+		return setBranchConfig(s.Branch, s.Prev)
+	}
+	return fmt.Errorf("unknown journal step %q", s.Op)
+}
+
+// Replace from with to in the branch config unless it was done already
+func setBranchConfig(from, to *branchInfo) error {
+	c, err := loadBranchConfig()
+	if err != nil {
+		return err
+	}
+	if _, ok := c.byGitName[from.Git]; !ok {
+		if _, ok := c.byGitName[to.Git]; ok {
+			return nil
+		}
+	}
+	return replaceBranchInConfig(from.Git, to)
+}
+
+func (j *journal) save() error {
+	data, err := json.MarshalIndent(j, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(journalName, data)
+}
+
+func loadJournal() (*journal, error) {
+	data, err := ioutil.ReadFile(journalName)
+	if err != nil {
+		return nil, err
+	}
+	j := new(journal)
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("%s: %s", journalName, err)
+	}
+	return j, nil
+}
+
+// Remove journal together with all backups and temporary things
+// belonging to the transaction
+func (j *journal) finish() error {
+	for _, s := range j.Steps {
+		if s.Op == stepReplaceFile {
+			// new file is left behind if the step wasn't applied
+			os.Remove(s.From)
+			if s.Undo != "" {
+				os.Remove(s.Undo)
+			}
+		}
+	}
+	for _, f := range j.CleanupFiles {
+		os.RemoveAll(f)
+	}
+	for _, b := range j.CleanupBranches {
+		if rev, err := git.ResolveRef("refs/heads/" + b); err == nil && rev != "" {
+			git.RemoveBranch(b)
+		}
+	}
+	return os.Remove(journalName)
+}
+
+func (j *journal) rollForward() error {
+	for j.Done < len(j.Steps) {
+		s := j.Steps[j.Done]
+		log.Debug("Applying ", s)
+		if err := s.apply(); err != nil {
+			return fmt.Errorf("%s: %s", s, err)
+		}
+		j.Done++
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *journal) rollBack() error {
+	// step which was in progress could have been applied partially
+	if j.Done < len(j.Steps) {
+		j.Done++
+	}
+	for j.Done > 0 {
+		s := j.Steps[j.Done-1]
+		log.Debug("Rolling back ", s)
+		if err := s.rollback(); err != nil {
+			return fmt.Errorf("rollback of %s: %s", s, err)
+		}
+		j.Done--
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply all steps of the transaction, rolling them back on failure.
+// Caller must hold repository lock.
+func runJournal(j *journal) {
+	for i, s := range j.Steps {
+		must(s.prepare(i))
+	}
+	gen := beginGeneration()
+	if err := j.save(); err != nil {
+		os.RemoveAll(gen)
+		panic(err)
+	}
+
+	if err := j.rollForward(); err != nil {
+		log.Error("Finalisation failed, rolling back: ", err)
+		os.RemoveAll(gen)
+		if rerr := j.rollBack(); rerr != nil {
+			log.Panicf("%s; %s. Run 'git-bzr-bridge recover'", err, rerr)
+		}
+		j.finish()
+		panic(err)
+	}
+	if gen != "" {
+		if err := saveGeneration(gen, j); err != nil {
+			// transaction is done, it just can't be rolled back later
+			log.Error("Can't save generation: ", err)
+			os.RemoveAll(gen)
+		}
+	}
+	must(j.finish())
+}
+
+// Finish or roll back interrupted transaction, if there is one.
+// Returns a description of what was done, or empty string if there
+// was nothing to recover.
+func recoverJournal() (string, error) {
+	if !exists(journalName) {
+		return "", nil
+	}
+	lk := lockRepo()
+	defer lk.Release()
+
+	// transaction could have been finished while we were waiting for the lock
+	j, err := loadJournal()
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// roll forward if possible, as all the hard work is already done
+	canApply := true
+	for i, s := range j.Steps[j.Done:] {
+		if err := s.canApply(i == 0); err != nil {
+			log.Infof("Can't finish interrupted transaction: %s", err)
+			canApply = false
+			break
+		}
+	}
+
+	var report string
+	if canApply {
+		n := len(j.Steps) - j.Done
+		if err := j.rollForward(); err != nil {
+			return "", err
+		}
+		report = fmt.Sprintf("finished interrupted transaction (%d of %d steps were pending)", n, len(j.Steps))
+	} else {
+		n := j.Done
+		if err := j.rollBack(); err != nil {
+			return "", err
+		}
+		report = fmt.Sprintf("rolled back interrupted transaction (%d of %d steps were applied)", n, len(j.Steps))
+	}
+	for _, s := range j.Steps {
+		report += "\n  " + s.String()
+	}
+	return report, j.finish()
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
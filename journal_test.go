@@ -0,0 +1,230 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Bridge with a transaction which isn't started yet: it replaces bzr marks,
+// renames temporary git branch, renames branch feature in the config
+// and sets notes reference
+func setupTransaction(t *testing.T) *journal {
+	b := &branchInfo{Url: "lp:feature", Bzr: filepath.Join(bzrRepo, "feature"), Git: "feature"}
+	tip := setupBridge(t, b)
+
+	newMarks := filepath.Join(tmpDir, "new.marks")
+	if err := ioutil.WriteFile(newMarks, []byte(":1 rev-1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.NewBranch("tmp", tip); err != nil {
+		t.Fatal(err)
+	}
+	renamed := *b
+	renamed.Git = "renamed"
+	j := &journal{
+		Steps: []*journalStep{
+			{Op: stepReplaceFile, From: newMarks, To: bzrMarks},
+			{Op: stepGitBranch, From: "tmp", To: "new"},
+			{Op: stepSetBranch, Prev: b, Branch: &renamed},
+			{Op: stepSetRef, From: tip, To: notesRef},
+		},
+		CleanupFiles: []string{newMarks},
+	}
+	for i, s := range j.Steps {
+		if err := s.prepare(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return j
+}
+
+// Check whether all steps of the transaction from setupTransaction are
+// applied, or none of them
+func checkTransaction(t *testing.T, applied bool) {
+	t.Helper()
+	if exists(journalName) {
+		t.Error("journal wasn't removed")
+	}
+	marks, err := ioutil.ReadFile(bzrMarks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, _ := git.ResolveRef("refs/heads/tmp")
+	branch, _ := git.ResolveRef("refs/heads/new")
+	notes, _ := git.ResolveRef(notesRef)
+	c, err := loadBranchConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := map[string]bool{
+		"marks":  string(marks) != "",
+		"branch": tmp == "" && branch != "",
+		"config": c.byGitName["renamed"] != nil && c.byGitName["feature"] == nil,
+		"notes":  notes != "",
+	}
+	for what, done := range state {
+		if done != applied {
+			t.Errorf("%s: applied %v, want %v", what, done, applied)
+		}
+	}
+}
+
+// Process is killed after applying n steps of the transaction. If inProgress
+// is set, step n is applied too, but it isn't recorded in the journal yet.
+func interrupt(t *testing.T, j *journal, n int, inProgress bool) {
+	last := n
+	if inProgress {
+		last++
+	}
+	for _, s := range j.Steps[:last] {
+		if err := s.apply(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Done = n
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverRollForward(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't available")
+	}
+	for n := 0; n < 4; n++ {
+		for _, inProgress := range []bool{false, true} {
+			j := setupTransaction(t)
+			interrupt(t, j, n, inProgress)
+			report, err := recoverJournal()
+			if err != nil {
+				t.Fatalf("%d, %v: %s", n, inProgress, err)
+			}
+			if !strings.HasPrefix(report, "finished") {
+				t.Errorf("%d, %v: unexpected report %q", n, inProgress, report)
+			}
+			checkTransaction(t, true)
+		}
+	}
+}
+
+func TestRecoverRollBack(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't available")
+	}
+	// source of the git branch step is gone, so it can't be finished
+	for _, n := range []int{0, 1} {
+		j := setupTransaction(t)
+		interrupt(t, j, n, false)
+		if err := git.DeleteRef("refs/heads/tmp"); err != nil {
+			t.Fatal(err)
+		}
+		report, err := recoverJournal()
+		if err != nil {
+			t.Fatalf("%d: %s", n, err)
+		}
+		if !strings.HasPrefix(report, "rolled back") {
+			t.Errorf("%d: unexpected report %q", n, report)
+		}
+		checkTransaction(t, false)
+	}
+
+	// new marks file is gone
+	j := setupTransaction(t)
+	interrupt(t, j, 0, false)
+	if err := os.Remove(j.Steps[0].From); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := recoverJournal(); err != nil || !strings.HasPrefix(report, "rolled back") {
+		t.Errorf("unexpected report %q, %v", report, err)
+	}
+	checkTransaction(t, false)
+}
+
+// Steps which could have been applied before the process was killed
+// are applied once more by recovery
+func TestReapplyStep(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't available")
+	}
+	j := setupTransaction(t)
+	for _, s := range j.Steps {
+		if err := s.apply(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.canApply(true); err != nil {
+			t.Errorf("%s: can't be re-applied: %s", s, err)
+		}
+		if err := s.apply(); err != nil {
+			t.Errorf("%s: re-apply failed: %s", s, err)
+		}
+	}
+	if err := j.finish(); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	checkTransaction(t, true)
+}
+
+// Interrupted pull into the hidden bzr branch is either finished,
+// or rolled back to its old tip
+func TestRecoverBzrPull(t *testing.T) {
+	if _, err := exec.LookPath("bzr"); err != nil {
+		t.Skip("bzr isn't available")
+	}
+	t.Setenv("BZR_EMAIL", "A <a@example.com>")
+	b := &branchInfo{Url: "lp:feature", Bzr: filepath.Join(bzrRepo, "feature"), Git: "feature"}
+	setupBridge(t, b)
+	bzrCmd := func(args ...string) {
+		if out, err := exec.Command("bzr", args...).CombinedOutput(); err != nil {
+			t.Fatalf("bzr %s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	other := filepath.Join(tmpDir, "other")
+	os.RemoveAll(b.Bzr)
+	bzrCmd("init-repo", "-q", tmpDir)
+	bzrCmd("init", "-q", b.Bzr)
+	bzrCmd("commit", "-q", "--unchanged", "-m", "one", b.Bzr)
+	bzrCmd("branch", "-q", b.Bzr, other)
+	bzrCmd("commit", "-q", "--unchanged", "-m", "two", other)
+	oldTip, err := bzr.Tip(b.Bzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTip, err := bzr.Tip(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rollBack := range []bool{false, true} {
+		j := &journal{Steps: []*journalStep{
+			{Op: stepBzrPull, From: other, To: b.Bzr},
+		}}
+		n, want := 0, newTip
+		if rollBack {
+			// pull is done, but new marks file which should be used next is gone
+			j.Steps = append(j.Steps, &journalStep{Op: stepReplaceFile, From: filepath.Join(tmpDir, "missing"), To: bzrMarks})
+			n, want = 1, oldTip
+		}
+		for i, s := range j.Steps {
+			if err := s.prepare(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		interrupt(t, j, n, false)
+		if _, err := recoverJournal(); err != nil {
+			t.Fatal(err)
+		}
+		if tip, err := bzr.Tip(b.Bzr); err != nil || tip != want {
+			t.Errorf("rollback %v: tip is %s, want %s (%v)", rollBack, tip, want, err)
+		}
+		if err := bzr.ResetTip(b.Bzr, oldTip); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
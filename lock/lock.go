@@ -0,0 +1,175 @@
+// Simple lock files which can be shared between several processes
+// and detect locks left behind by dead processes
+package lock
+
+import (
+	l "github.com/usovalx/git-bzr-bridge/log"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var log = l.New("lock")
+
+// How often to re-check a lock held by somebody else
+var PollInterval = 200 * time.Millisecond
+
+// A Lock represents lock file held by the current process
+type Lock struct {
+	path string
+}
+
+// Owner of the lock as recorded in the lock file
+type Owner struct {
+	Pid  int
+	Host string
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("pid %d on %s", o.Pid, o.Host)
+}
+
+// Error returned when lock can't be acquired in the given time
+type TimeoutError struct {
+	Path  string
+	Owner Owner
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out waiting for lock %s held by %s", e.Path, e.Owner)
+}
+
+// Acquire lock file at the given path, waiting up to timeout for it
+// to be released by its current owner. Locks left by dead processes
+// on the same host are removed automatically. Zero timeout means
+// a single attempt.
+func Acquire(path string, timeout time.Duration) (*Lock, error) {
+	me, err := self()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	reported := false
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			_, werr := fmt.Fprintf(f, "%d %s\n", me.Pid, me.Host)
+			cerr := f.Close()
+			if werr == nil {
+				werr = cerr
+			}
+			if werr != nil {
+				os.Remove(path)
+				return nil, werr
+			}
+			log.Debugf("Acquired %s", path)
+			return &Lock{path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// somebody else holds the lock -- check if it is still alive
+		owner, err := ReadOwner(path)
+		if os.IsNotExist(err) {
+			continue // just released
+		}
+		if err == nil && isStale(owner, me) {
+			log.Infof("Removing stale lock %s held by %s", path, owner)
+			if err := breakLock(path, owner); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// lock file is being written right now or owner is alive
+
+		if !time.Now().Before(deadline) {
+			return nil, &TimeoutError{path, owner}
+		}
+		if !reported {
+			log.Infof("Waiting for lock %s held by %s", path, owner)
+			reported = true
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+// Release the lock
+func (lk *Lock) Release() error {
+	log.Debugf("Releasing %s", lk.path)
+	return os.Remove(lk.path)
+}
+
+// Path of the lock file
+func (lk *Lock) Path() string {
+	return lk.path
+}
+
+// Read owner information from the lock file
+func ReadOwner(path string) (Owner, error) {
+	var o Owner
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return o, err
+	}
+	s := strings.Fields(string(data))
+	if len(s) != 2 {
+		return o, fmt.Errorf("%s: invalid lock file %q", path, string(data))
+	}
+	o.Pid, err = strconv.Atoi(s[0])
+	if err != nil {
+		return o, fmt.Errorf("%s: invalid pid in lock file %q", path, string(data))
+	}
+	o.Host = s[1]
+	return o, nil
+}
+
+func self() (Owner, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return Owner{}, err
+	}
+	return Owner{os.Getpid(), host}, nil
+}
+
+// Lock is stale if its owner was running on this host and is dead now.
+// We can't say anything about processes running on other hosts.
+func isStale(owner, me Owner) bool {
+	if owner.Host != me.Host {
+		return false
+	}
+	if owner.Pid == me.Pid {
+		return false
+	}
+	err := syscall.Kill(owner.Pid, 0)
+	return err == syscall.ESRCH
+}
+
+// Remove stale lock, making sure that it wasn't re-acquired by somebody
+// else while we were looking at it
+func breakLock(path string, owner Owner) error {
+	current, err := ReadOwner(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current != owner {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
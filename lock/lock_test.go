@@ -0,0 +1,97 @@
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempLockPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lock_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "sub", "test.lock")
+}
+
+func TestAcquireRelease(t *testing.T) {
+	path := tempLockPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	lk, err := Acquire(path, 0)
+	if err != nil {
+		t.Fatal("Can't acquire free lock: ", err)
+	}
+	owner, err := ReadOwner(path)
+	if err != nil {
+		t.Fatal("Can't read lock owner: ", err)
+	}
+	if owner.Pid != os.Getpid() {
+		t.Errorf("Wrong pid in the lock file: %d", owner.Pid)
+	}
+	if err := lk.Release(); err != nil {
+		t.Fatal("Can't release lock: ", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Lock file still exists after release")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	path := tempLockPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	lk, err := Acquire(path, 0)
+	if err != nil {
+		t.Fatal("Can't acquire free lock: ", err)
+	}
+	defer lk.Release()
+
+	PollInterval = 10 * time.Millisecond
+	start := time.Now()
+	_, err = Acquire(path, 50*time.Millisecond)
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Acquire gave up too early")
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	path := tempLockPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	// find a pid which surely doesn't exist
+	me, err := self()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Dir(path), 0777)
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d %s\n", 1<<22+1, me.Host)), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	lk, err := Acquire(path, 0)
+	if err != nil {
+		t.Fatal("Stale lock wasn't removed: ", err)
+	}
+	lk.Release()
+}
+
+func TestForeignHostLock(t *testing.T) {
+	path := tempLockPath(t)
+	defer os.RemoveAll(filepath.Dir(filepath.Dir(path)))
+
+	os.MkdirAll(filepath.Dir(path), 0777)
+	if err := ioutil.WriteFile(path, []byte("1 some.other.host\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Acquire(path, 0); err == nil {
+		t.Fatal("Lock held by another host was broken")
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"github.com/usovalx/git-bzr-bridge/fastimport"
+	"github.com/usovalx/git-bzr-bridge/lock"
 	l "github.com/usovalx/git-bzr-bridge/log"
+	"github.com/usovalx/git-bzr-bridge/markindex"
 
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -12,9 +16,12 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,9 +30,16 @@ var log = l.New("git-bzr-bridge")
 // some constants
 const bzrRepo = "bzr"
 const branchConfigName = "git-bzr-bridge-branches.cfg"
+const bridgeConfigName = "git-bzr-bridge.cfg"
 const bzrMarks = "git-bzr-bridge-bzr.marks"
 const gitMarks = "git-bzr-bridge-git.marks"
 const tmpDir = "git-bzr-bridge-tmp"
+const queueDir = "git-bzr-bridge-queue"
+const repoLockName = "git-bzr-bridge.lock"
+const branchLocksDir = "locks"
+
+// how long to wait for locks held by other processes
+var lockTimeout time.Duration
 
 type commandInfo struct {
 	cmd         func([]string)
@@ -33,18 +47,76 @@ type commandInfo struct {
 }
 
 var commands = map[string]commandInfo{
-	"branches":     {branchesCmd, "list branches"},
-	"init":         {initCmd, "create a new repository"},
-	"import":       {importCmd, "import new bzr branch"},
-	"test-install": {testInstallCmd, "basic check of the setup"},
-	"update":       {updateCmd, "pull new revisions from bzr and import them into git"},
-	"update-hook":  {updateHookCmd, "accept new revisions from git and push them into bzr"},
+	"branches":          {branchesCmd, "list branches"},
+	"init":              {initCmd, "create a new repository"},
+	"fsck":              {fsckCmd, "check consistency of marks, branches and config"},
+	"import":            {importCmd, "import new bzr branch"},
+	"install-hooks":     {installHooksCmd, "install git hooks calling git-bzr-bridge"},
+	"map":               {mapCmd, "translate between git commits and bzr revisions"},
+	"post-receive-hook": {postReceiveHookCmd, "queue pushed references for export into bzr"},
+	"pre-receive-hook":  {preReceiveHookCmd, "accept pushes of several references from git all at once"},
+	"queue":             {queueCmd, "list queued pushes"},
+	"recover":           {recoverCmd, "finish or roll back interrupted import or push"},
+	"relocate":          {relocateCmd, "change url of bzr branch"},
+	"remove":            {removeCmd, "unregister bzr branch"},
+	"repair-marks":      {repairMarksCmd, "restore missing entries of the marks files"},
+	"replay":            {replayCmd, "feed archived fast-export stream into fast-import again"},
+	"rename":            {renameCmd, "rename git branch"},
+	"rollback":          {rollbackCmd, "undo the last imports, pushes or config changes"},
+	"test-install":      {testInstallCmd, "basic check of the setup"},
+	"update":            {updateCmd, "pull new revisions from bzr and import them into git"},
+	"update-hook":       {updateHookCmd, "accept new revisions from git and push them into bzr"},
+	"worker":            {workerCmd, "export queued pushes into bzr"},
 }
 
 type branchInfo struct {
 	Url, Bzr, Git string
+	Tags          *tagsInfo `json:",omitempty"`
+	// What to do when git branch is deleted by push
+	OnDelete string `json:",omitempty"`
+	// Archived branches aren't updated and don't accept pushes
+	Frozen bool `json:",omitempty"`
+	// Direction of synchronization, bidirectional by default
+	Mode string `json:",omitempty"`
+}
+
+// Values of branchInfo.Mode
+const (
+	modeBidirectional = "bidirectional"
+	modeMirror        = "mirror" // bzr -> git only, pushes are rejected
+	modePush          = "push"   // git -> bzr only, not updated from bzr
+)
+
+func (b *branchInfo) mode() string {
+	if b.Mode == "" {
+		return modeBidirectional
+	}
+	return b.Mode
+}
+
+// Check whether the branch accepts pushes from git
+func (b *branchInfo) checkPushable() error {
+	if b.Frozen {
+		return fmt.Errorf("Branch %q is archived and doesn't accept pushes", b.Git)
+	}
+	return b.checkMirror()
 }
 
+// Check that the branch isn't a read-only mirror
+func (b *branchInfo) checkMirror() error {
+	if b.mode() == modeMirror {
+		return fmt.Errorf("Branch %q is a read-only mirror of %s", b.Git, b.Url)
+	}
+	return nil
+}
+
+// Values of branchInfo.OnDelete
+const (
+	deleteRefuse     = "refuse"     // reject the push (default)
+	deleteUnregister = "unregister" // remove branch from config and delete hidden bzr branch
+	deleteArchive    = "archive"    // keep everything but mark the branch as frozen
+)
+
 type branchList []*branchInfo
 
 type branchConfig struct {
@@ -53,6 +125,37 @@ type branchConfig struct {
 	byGitName map[string]*branchInfo
 }
 
+// Global settings of the bridge. Config file is optional and
+// all settings have reasonable defaults
+type bridgeConfig struct {
+	// Templates for creating bzr branches by pushing new git branches
+	Templates []*urlTemplate `json:",omitempty"`
+	// Accept pushes after validation and export them into bzr later
+	// from the queue (see post-receive-hook and worker commands)
+	Async bool `json:",omitempty"`
+	// How many times to try failed queued jobs. Defaults to 5
+	MaxAttempts int `json:",omitempty"`
+	// Fail on known defects of fast-export streams instead of repairing them
+	StrictStreams bool `json:",omitempty"`
+	// Record bzr revision ids and revnos of imported commits as git notes
+	Notes bool `json:",omitempty"`
+	// How many generations of marks files and branch config to keep
+	// for rollback. Defaults to 5, negative value disables them
+	Generations int `json:",omitempty"`
+	// Save every fast-export stream, see streamsDir
+	ArchiveStreams bool `json:",omitempty"`
+}
+
+type urlTemplate struct {
+	// Pattern for git branch names, see path.Match
+	Branch string
+	// Url of the new bzr branch. {branch} is replaced with the git branch
+	// name, {name} with the last element of it
+	Url string
+	// Tags settings of the new branches
+	Tags *tagsInfo `json:",omitempty"`
+}
+
 type marks struct {
 	byRev  map[string]int
 	byMark map[int]string
@@ -74,6 +177,7 @@ func main() {
 	var debug = fs.Bool("d", false, "debug logging")
 	var help = fs.Bool("h", false, "show usage message and options")
 	var wd = fs.String("C", "", "change to this directory before doing anything else")
+	fs.DurationVar(&lockTimeout, "lock-timeout", 10*time.Minute, "how long to wait for locks held by other processes")
 	fs.Usage = func() { showUsage(fs) }
 	fs.Parse(os.Args[1:])
 
@@ -98,6 +202,15 @@ func main() {
 	// choose subcommand and run it
 	if fs.NArg() > 0 {
 		if cmd, ok := commands[fs.Arg(0)]; ok {
+			// clean up after previous run if it was interrupted
+			// (fsck only reports it)
+			if fs.Arg(0) != "recover" && fs.Arg(0) != "fsck" {
+				report, err := recoverJournal()
+				must(err)
+				if report != "" {
+					log.Info("Recovered: ", report)
+				}
+			}
 			cmd.cmd(fs.Args()[1:])
 			os.Exit(0)
 		}
@@ -123,7 +236,7 @@ func showUsage(fs *flag.FlagSet) {
 
 	fmt.Println("\ncommands:")
 	for _, k := range cmds {
-		fmt.Printf("  %-12s  %s\n", k, commands[k].description)
+		fmt.Printf("  %-17s  %s\n", k, commands[k].description)
 	}
 
 	fmt.Println("\nRun 'git-bzr-bridge <command> -h' to get usage message for <command>")
@@ -135,14 +248,62 @@ func must(err error) {
 	}
 }
 
+// Run f and convert any panic into error
+func capture(f func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if e, ok := e.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("%s", e)
+			}
+		}
+	}()
+	f()
+	return nil
+}
+
 func tempBranchName() string {
 	// FIXME: should it also check that branch doesn't exists yet?
 	return fmt.Sprintf("__bzr_import_%d_%d", os.Getpid(), rand.Uint32())
 }
 
-func loadBranchConfig() (*branchConfig, error) {
-	// FIXME: file locking
+// Repository lock held by the current process. Goroutines of the same
+// process are serialized with a mutex before they go for the lock file.
+type repoLock struct {
+	*lock.Lock
+}
+
+var repoMutex sync.Mutex
+
+// Take repository-wide lock protecting marks files and branch config.
+// Any code which updates them must hold this lock.
+func lockRepo() repoLock {
+	repoMutex.Lock()
+	lk, err := lock.Acquire(repoLockName, lockTimeout)
+	if err != nil {
+		repoMutex.Unlock()
+		panic(err)
+	}
+	return repoLock{lk}
+}
+
+func (lk repoLock) Release() error {
+	defer repoMutex.Unlock()
+	return lk.Lock.Release()
+}
+
+// Take per-branch lock, serializing all operations on the given git branch
+func lockBranch(gitBranch string) *lock.Lock {
+	name := strings.NewReplacer("%", "%25", "/", "%2F").Replace(gitBranch)
+	lk, err := lock.Acquire(filepath.Join(tmpDir, branchLocksDir, name+".lock"), lockTimeout)
+	must(err)
+	return lk
+}
 
+// Branch config is always replaced atomically, so it is safe to read
+// it without holding repository lock.
+func loadBranchConfig() (*branchConfig, error) {
 	// read file
 	data, ferr := ioutil.ReadFile(branchConfigName)
 	if ferr != nil {
@@ -153,7 +314,10 @@ func loadBranchConfig() (*branchConfig, error) {
 	if err := json.Unmarshal(data, &arr); err != nil {
 		return nil, err
 	}
+	return newBranchConfig(arr)
+}
 
+func newBranchConfig(arr branchList) (*branchConfig, error) {
 	// fill in cross-maps of the branchConfig and validate it on the way
 	c := new(branchConfig)
 	c.branches = arr
@@ -172,6 +336,21 @@ func loadBranchConfig() (*branchConfig, error) {
 		if b.Git == "" {
 			return nil, err(i, "empty git branch name")
 		}
+		switch b.OnDelete {
+		case "", deleteRefuse, deleteUnregister, deleteArchive:
+		default:
+			return nil, err(i, "invalid OnDelete policy")
+		}
+		switch b.Mode {
+		case "", modeBidirectional, modeMirror, modePush:
+		default:
+			return nil, err(i, "invalid mode")
+		}
+		if b.Tags != nil {
+			if e := b.Tags.validate(); e != nil {
+				return nil, err(i, e.Error())
+			}
+		}
 		if _, ok := c.byBzrName[b.Bzr]; ok {
 			return nil, err(i, "duplicate bzr branch name")
 		}
@@ -184,28 +363,155 @@ func loadBranchConfig() (*branchConfig, error) {
 	return c, nil
 }
 
-func addBranchToConfig(url, bzrName, gitName string) error {
-	// FIXME: file locking
-	data, ferr := ioutil.ReadFile(branchConfigName)
-	if ferr != nil {
-		return ferr
+func loadBridgeConfig() (*bridgeConfig, error) {
+	c := new(bridgeConfig)
+	data, err := ioutil.ReadFile(bridgeConfigName)
+	if os.IsNotExist(err) {
+		data, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %s", bridgeConfigName, err)
 	}
 
-	arr := make([]*branchInfo, 0, 10)
-	if err := json.Unmarshal(data, &arr); err != nil {
+	if c.MaxAttempts < 0 {
+		return nil, fmt.Errorf("%s: negative MaxAttempts", bridgeConfigName)
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 5
+	}
+	if c.Generations == 0 {
+		c.Generations = 5
+	}
+	for i, t := range c.Templates {
+		if _, err := path.Match(t.Branch, ""); err != nil || t.Branch == "" {
+			return nil, fmt.Errorf("%s: invalid branch pattern in template %d", bridgeConfigName, i)
+		}
+		if t.Url == "" {
+			return nil, fmt.Errorf("%s: empty url in template %d", bridgeConfigName, i)
+		}
+		if t.Tags != nil {
+			if err := t.Tags.validate(); err != nil {
+				return nil, fmt.Errorf("%s: %s in template %d", bridgeConfigName, err, i)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Config for the new branch created from the first matching url template,
+// or nil if there is no such template
+func (c *bridgeConfig) newBranch(gitBranch string) *branchInfo {
+	for _, t := range c.Templates {
+		if ok, _ := path.Match(t.Branch, gitBranch); ok {
+			url := strings.NewReplacer("{branch}", gitBranch, "{name}", path.Base(gitBranch)).Replace(t.Url)
+			return &branchInfo{
+				Url:  url,
+				Bzr:  filepath.FromSlash(path.Join(bzrRepo, gitBranch)),
+				Git:  gitBranch,
+				Tags: t.Tags,
+			}
+		}
+	}
+	return nil
+}
+
+// Caller must hold repository lock
+func addBranchToConfig(b *branchInfo) error {
+	c, err := loadBranchConfig()
+	if err != nil {
+		return err
+	}
+
+	arr := append(c.branches, b)
+	return writeBranchConfig(arr)
+}
+
+// Caller must hold repository lock
+func removeBranchFromConfig(gitName string) error {
+	c, err := loadBranchConfig()
+	if err != nil {
+		return err
+	}
+
+	arr := make(branchList, 0, len(c.branches))
+	for _, b := range c.branches {
+		if b.Git != gitName {
+			arr = append(arr, b)
+		}
+	}
+	return writeBranchConfig(arr)
+}
+
+// Replace config entry of gitName with b.
+// Caller must hold repository lock.
+func replaceBranchInConfig(gitName string, b *branchInfo) error {
+	c, err := loadBranchConfig()
+	if err != nil {
+		return err
+	}
+
+	arr, err := c.replaced(gitName, b)
+	if err != nil {
+		return err
+	}
+	return writeBranchConfig(arr)
+}
+
+// Copy of the branch list with gitName entry replaced by b
+func (c *branchConfig) replaced(gitName string, b *branchInfo) (branchList, error) {
+	if _, ok := c.byGitName[gitName]; !ok {
+		return nil, fmt.Errorf("%s: unknown branch %q", branchConfigName, gitName)
+	}
+	arr := make(branchList, len(c.branches))
+	for i, v := range c.branches {
+		if v.Git == gitName {
+			arr[i] = b
+		} else {
+			arr[i] = v
+		}
+	}
+	return arr, nil
+}
+
+// Validate and atomically replace branch config.
+// Caller must hold repository lock.
+func writeBranchConfig(arr branchList) error {
+	if _, err := newBranchConfig(arr); err != nil {
 		return err
 	}
 
-	arr = append(arr, &branchInfo{Url: url, Bzr: bzrName, Git: gitName})
 	data, err := json.MarshalIndent(arr, "", " ")
 	if err != nil {
 		return err
 	}
+	return writeFileAtomic(branchConfigName, data)
+}
 
-	if err := ioutil.WriteFile(branchConfigName, data, 0777); err != nil {
+// Replace file with new content, so that readers will see either
+// old or new version of it but never anything in between
+func writeFileAtomic(name string, data []byte) error {
+	f, err := ioutil.TempFile(tmpDir, filepath.Base(name))
+	if err != nil {
 		return err
 	}
-	return nil
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0666); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
 }
 
 func loadMarks(path string) (*marks, error) {
@@ -243,6 +549,81 @@ func loadMarks(path string) (*marks, error) {
 	panic("unreachable")
 }
 
+// Write marks into the file in the format used by fast-import
+func writeMarks(path string, m *marks) error {
+	var all []int
+	for mark := range m.byMark {
+		all = append(all, mark)
+	}
+	sort.Ints(all)
+	var buf bytes.Buffer
+	for _, mark := range all {
+		fmt.Fprintf(&buf, ":%d %s\n", mark, m.byMark[mark])
+	}
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// Find revision from the other marks file which has the same mark as rev
+func (m *marks) translate(rev string, other *marks) (string, bool) {
+	mark, ok := m.byRev[rev]
+	if !ok {
+		return "", false
+	}
+	r, ok := other.byMark[mark]
+	return r, ok
+}
+
+// Indexes of both marks files. They are used instead of loadMarks when only
+// a few revisions have to be looked up, which is a lot faster on big repos.
+type marksIndex struct {
+	bzr, git *markindex.Index
+}
+
+// Caller must hold repository lock, lookups are fine after releasing it
+// (they will see marks files as they were when the index was opened).
+func openMarksIndex() *marksIndex {
+	b, err := markindex.Open(bzrMarks)
+	must(err)
+	g, err := markindex.Open(gitMarks)
+	if err != nil {
+		b.Close()
+		panic(err)
+	}
+	return &marksIndex{bzr: b, git: g}
+}
+
+func (m *marksIndex) Close() {
+	m.bzr.Close()
+	m.git.Close()
+}
+
+func markOf(x *markindex.Index, rev string) (int, bool) {
+	mark, ok, err := x.Mark(rev)
+	must(err)
+	return mark, ok
+}
+
+func revOf(x *markindex.Index, mark int) (string, bool) {
+	rev, ok, err := x.Rev(mark)
+	must(err)
+	return rev, ok
+}
+
+// Find revision from the other index which has the same mark as rev
+func translateRev(from, to *markindex.Index, rev string) (string, bool) {
+	r, ok, err := from.Translate(rev, to)
+	must(err)
+	return r, ok
+}
+
+// Find bzr revision corresponding to the git commit.
+// Caller must hold repository lock.
+func bzrRevision(commit string) (string, bool) {
+	mi := openMarksIndex()
+	defer mi.Close()
+	return translateRev(mi.git, mi.bzr, commit)
+}
+
 type CountReader struct {
 	read uint64
 	r    io.ReadCloser
@@ -266,7 +647,29 @@ func NewCountReader(r io.ReadCloser) *CountReader {
 	return &CountReader{0, r}
 }
 
-func RunPipe(src, dst *exec.Cmd) (int64, error) {
+// Filters applied to the streams between bzr and git
+// (or in the opposite direction if toBzr is true)
+func streamFilters(toBzr bool) []fastimport.Filter {
+	bc, err := loadBridgeConfig()
+	must(err)
+	filters := []fastimport.Filter{
+		fastimport.Sanitize(bc.StrictStreams, func(c *fastimport.Commit, fix string) {
+			log.Infof("Repaired broken stream, commit %s of %s: %s", c.Mark, c.Ref, fix)
+		}),
+	}
+	authors, err := loadAuthorsMap()
+	must(err)
+	if authors != nil {
+		filters = append(filters, authorsFilter(authors, toBzr))
+	}
+	return filters
+}
+
+// Run src and dst commands feeding fast-export stream produced by src into dst.
+// If any filters are given, the stream is parsed and passed through them.
+// If archive isn't nil, everything fed into dst is also written into it.
+// Returns number of bytes produced by src.
+func RunPipe(src, dst *exec.Cmd, archive io.Writer, filters ...fastimport.Filter) (int64, error) {
 	if src.Stdout != nil {
 		return 0, fmt.Errorf("RunPipe: stdout already set on source")
 	}
@@ -302,7 +705,19 @@ func RunPipe(src, dst *exec.Cmd) (int64, error) {
 	}
 
 	log.Spam("RunPipe: copying data")
-	copied, copyErr := io.Copy(pw, pr)
+	var w io.Writer = pw
+	if archive != nil {
+		w = io.MultiWriter(pw, archive)
+	}
+	var copied int64
+	var copyErr error
+	if len(filters) == 0 {
+		copied, copyErr = io.Copy(w, pr)
+	} else {
+		cr := NewCountReader(pr)
+		copyErr = fastimport.Run(w, cr, filters...)
+		copied = int64(cr.NData())
+	}
 	if copyErr == io.EOF {
 		copyErr = nil // EOF isn't really an error in this case
 	}
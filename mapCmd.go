@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func mapCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("map", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	asJson := fs.Bool("json", false, "print results as JSON, one object per line")
+	fs.Usage = func() { mapUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	queries := fs.Args()
+	if len(queries) == 0 {
+		// batch mode
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			if q := strings.TrimSpace(s.Text()); q != "" {
+				queries = append(queries, q)
+			}
+		}
+		must(s.Err())
+	}
+
+	c, err := loadBranchConfig()
+	must(err)
+	mi := func() *marksIndex {
+		lk := lockRepo()
+		defer lk.Release()
+		return openMarksIndex()
+	}()
+	defer mi.Close()
+
+	failed := false
+	enc := json.NewEncoder(os.Stdout)
+	for _, q := range queries {
+		r := mapRevision(c, mi, q)
+		if r.Error != "" {
+			failed = true
+		}
+		if *asJson {
+			must(enc.Encode(r))
+			continue
+		}
+		if r.Error != "" {
+			log.Errorf("%s: %s", q, r.Error)
+			continue
+		}
+		fmt.Print(r.Git, " ", r.Revid)
+		if r.Revno != "" {
+			fmt.Printf(" %s:%s", r.Branch, r.Revno)
+		}
+		fmt.Println()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+type mapResult struct {
+	Query string
+	Git   string `json:",omitempty"`
+	Revid string `json:",omitempty"`
+	// revno is only known for <branch>:<revno> queries or from git notes
+	Branch string `json:",omitempty"`
+	Revno  string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// Find git commit and bzr revision for the query
+func mapRevision(c *branchConfig, mi *marksIndex, q string) *mapResult {
+	r := &mapResult{Query: q}
+	err := capture(func() {
+		switch i := strings.Index(q, ":"); {
+		case strings.HasPrefix(q, "revid:"):
+			r.Revid = q[len("revid:"):]
+		case i >= 0:
+			r.Branch, r.Revno = q[:i], q[i+1:]
+			b, ok := c.byGitName[r.Branch]
+			if !ok {
+				panic(fmt.Errorf("unknown branch %q", r.Branch))
+			}
+			revid, err := bzr.RevisionId(b.Bzr, r.Revno)
+			if err != nil {
+				panic(fmt.Errorf("can't find revno %s in %s: %s", r.Revno, b.Bzr, err))
+			}
+			r.Revid = revid
+		default:
+			commit, err := git.ResolveRef(q + "^{commit}")
+			must(err)
+			if commit == "" {
+				panic(fmt.Errorf("unknown git commit"))
+			}
+			revid, ok := translateRev(mi.git, mi.bzr, commit)
+			if !ok {
+				panic(fmt.Errorf("commit %s isn't in the marks files", commit))
+			}
+			r.Git, r.Revid = commit, revid
+			note, err := git.Note(notesRef, commit)
+			must(err)
+			if _, revno, branch := parseBzrNote(note); revno != "" {
+				r.Branch, r.Revno = branch, revno
+			}
+			return
+		}
+
+		commit, ok := translateRev(mi.bzr, mi.git, r.Revid)
+		if !ok {
+			panic(fmt.Errorf("revision %s isn't in the marks files", r.Revid))
+		}
+		r.Git = commit
+	})
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func mapUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge map [-h] [-json] [<rev>...]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+map will find git commits and bzr revisions corresponding to each other.
+<rev> can be a git commit (abbreviated names and references are fine too),
+a bzr revision id as revid:<id>, or <branch>:<revno> where <branch> is
+a name of the git branch and <revno> is a (dotted) revno in its bzr branch.
+
+For every <rev> it prints the git commit and the bzr revision id, followed
+by <branch>:<revno> if it's known (from the query itself or from git notes).
+If no <rev> is given, they are read from stdin one per line.
+`)
+}
@@ -0,0 +1,404 @@
+// On-disk index of fast-import marks files, which allows looking up
+// a single mark or revision without parsing the whole marks file.
+//
+// Marks files in the text format stay the primary copy, index is derived
+// from them. When marks file is extended by an import, Update builds the new
+// index from the old one, and Open rebuilds the index from scratch if it's
+// stale.
+//
+// Keeping the text files primary is deliberate: fast-import and fast-export
+// read and write them on every run anyway, so exporting the text from the
+// index only when they need it would cost the same while adding another
+// format which could get out of sync. Index only saves parsing of the whole
+// file when a few marks are looked up.
+package markindex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Index file layout, all numbers are little-endian:
+//
+//	header:   magic, number of entries, size and mtime of the marks file
+//	entries:  {mark uint64, offset uint64, length uint64} sorted by mark
+//	byRev:    entry numbers (uint32) sorted by revision
+//	strings:  revisions, offsets of entries are relative to this area
+const (
+	magic       = "GBBMIDX1"
+	headerSize  = 8 + 8 + 8 + 8
+	entrySize   = 24
+	byRevSize   = 4
+	IndexSuffix = ".idx"
+)
+
+type Index struct {
+	f       *os.File
+	n       int64
+	strings int64 // offset of the strings area
+}
+
+type entry struct {
+	mark int
+	rev  string
+}
+
+// Open index of the marks file at path, (re)building it if it's missing or
+// stale. Caller must make sure that marks file doesn't change meanwhile.
+func Open(path string) (*Index, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	x, err := openIndex(path+IndexSuffix, st)
+	if err == nil {
+		return x, nil
+	}
+	if err := Build(path); err != nil {
+		return nil, err
+	}
+	return openIndex(path+IndexSuffix, st)
+}
+
+// Open index file if it's up to date with the marks file
+func openIndex(name string, marks os.FileInfo) (*Index, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	var h [headerSize]byte
+	if _, err := f.ReadAt(h[:], 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	n := int64(binary.LittleEndian.Uint64(h[8:]))
+	size := int64(binary.LittleEndian.Uint64(h[16:]))
+	mtime := int64(binary.LittleEndian.Uint64(h[24:]))
+	if string(h[:8]) != magic || size != marks.Size() || mtime != marks.ModTime().UnixNano() {
+		f.Close()
+		return nil, fmt.Errorf("%s is stale", name)
+	}
+	return &Index{f: f, n: n, strings: headerSize + n*(entrySize+byRevSize)}, nil
+}
+
+func (x *Index) Close() error {
+	return x.f.Close()
+}
+
+// Number of marks in the index
+func (x *Index) Len() int {
+	return int(x.n)
+}
+
+// Build index for the marks file at path
+func Build(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	entries, err := parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	byRev := make([]uint32, len(entries))
+	for i := range byRev {
+		byRev[i] = uint32(i)
+	}
+	sort.SliceStable(byRev, func(i, j int) bool {
+		return entries[byRev[i]].rev < entries[byRev[j]].rev
+	})
+	return write(path, st, entries, byRev)
+}
+
+// Build index for the marks file at path, which was written by fast-import or
+// fast-export from the marks file base. Marks of base are taken from its index
+// and only new marks are sorted. If path isn't an extension of base (e.g. some
+// marks were removed or changed), index is built from scratch.
+func Update(path, base string) error {
+	x, err := Open(base)
+	if os.IsNotExist(err) {
+		return Build(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer x.Close()
+	entries, byRev, err := x.load()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	maxMark := 0
+	if len(entries) != 0 {
+		maxMark = entries[len(entries)-1].mark
+	}
+	seen := 0
+	added := make(map[int]string)
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		mark, rev, ok := parseLine(s.Bytes())
+		if !ok {
+			continue
+		}
+		if mark > maxMark {
+			added[mark] = string(rev)
+			continue
+		}
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].mark >= mark })
+		if i == len(entries) || entries[i].mark != mark || entries[i].rev != string(rev) {
+			return Build(path)
+		}
+		seen++
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if seen != len(entries) {
+		return Build(path)
+	}
+
+	// new marks are bigger than the old ones, so entries stay sorted by mark
+	n := len(entries)
+	for mark, rev := range added {
+		entries = append(entries, entry{mark, rev})
+	}
+	sort.Slice(entries[n:], func(i, j int) bool { return entries[n+i].mark < entries[n+j].mark })
+	newByRev := make([]uint32, 0, len(added))
+	for i := n; i < len(entries); i++ {
+		newByRev = append(newByRev, uint32(i))
+	}
+	sort.Slice(newByRev, func(i, j int) bool {
+		return entries[newByRev[i]].rev < entries[newByRev[j]].rev
+	})
+
+	// merge both revision orders
+	merged := make([]uint32, 0, len(entries))
+	i, j := 0, 0
+	for i < len(byRev) || j < len(newByRev) {
+		if j == len(newByRev) || (i < len(byRev) && entries[byRev[i]].rev <= entries[newByRev[j]].rev) {
+			merged = append(merged, byRev[i])
+			i++
+		} else {
+			merged = append(merged, newByRev[j])
+			j++
+		}
+	}
+	return write(path, st, entries, merged)
+}
+
+// Write index of the marks file at path, entries must be sorted by mark
+// and byRev must list them in revision order
+func write(path string, st os.FileInfo, entries []entry, byRev []uint32) error {
+	size := headerSize + len(entries)*(entrySize+byRevSize)
+	for _, e := range entries {
+		size += len(e.rev)
+	}
+	var buf bytes.Buffer
+	buf.Grow(size)
+	buf.WriteString(magic)
+	putUint64(&buf, uint64(len(entries)))
+	putUint64(&buf, uint64(st.Size()))
+	putUint64(&buf, uint64(st.ModTime().UnixNano()))
+	var offset uint64
+	for _, e := range entries {
+		putUint64(&buf, uint64(e.mark))
+		putUint64(&buf, offset)
+		putUint64(&buf, uint64(len(e.rev)))
+		offset += uint64(len(e.rev))
+	}
+	for _, i := range byRev {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], i)
+		buf.Write(b[:])
+	}
+	for _, e := range entries {
+		buf.WriteString(e.rev)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+IndexSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path+IndexSuffix)
+}
+
+// Read all entries of the index together with their revision order
+func (x *Index) load() ([]entry, []uint32, error) {
+	st, err := x.f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	table := make([]byte, x.strings-headerSize)
+	if _, err := x.f.ReadAt(table, headerSize); err != nil {
+		return nil, nil, err
+	}
+	strs := make([]byte, st.Size()-x.strings)
+	if _, err := x.f.ReadAt(strs, x.strings); err != nil {
+		return nil, nil, err
+	}
+
+	entries := make([]entry, x.n)
+	for i := range entries {
+		b := table[i*entrySize:]
+		offset := binary.LittleEndian.Uint64(b[8:])
+		length := binary.LittleEndian.Uint64(b[16:])
+		if offset+length > uint64(len(strs)) {
+			return nil, nil, fmt.Errorf("%s is corrupted", x.f.Name())
+		}
+		entries[i] = entry{int(binary.LittleEndian.Uint64(b[0:])), string(strs[offset : offset+length])}
+	}
+	byRev := make([]uint32, x.n)
+	for i := range byRev {
+		byRev[i] = binary.LittleEndian.Uint32(table[x.n*entrySize+int64(i)*byRevSize:])
+	}
+	return entries, byRev, nil
+}
+
+func putUint64(w *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+// Parse marks file, returns entries sorted by mark. Invalid lines are
+// skipped, later lines override earlier ones (same as fast-import does).
+func parse(r io.Reader) ([]entry, error) {
+	byMark := make(map[int]string)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if mark, rev, ok := parseLine(s.Bytes()); ok {
+			byMark[mark] = string(rev)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	entries := make([]entry, 0, len(byMark))
+	for mark, rev := range byMark {
+		entries = append(entries, entry{mark, rev})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mark < entries[j].mark })
+	return entries, nil
+}
+
+// Parse ":<mark> <revision>" line of the marks file
+func parseLine(line []byte) (mark int, rev []byte, ok bool) {
+	sp := bytes.IndexByte(line, ' ')
+	if len(line) < 2 || line[0] != ':' || sp < 0 {
+		return 0, nil, false
+	}
+	mark, err := strconv.Atoi(string(line[1:sp]))
+	rev = bytes.TrimSpace(line[sp+1:])
+	if err != nil || mark <= 0 || len(rev) == 0 {
+		return 0, nil, false
+	}
+	return mark, rev, true
+}
+
+// Read i-th entry of the index
+func (x *Index) entry(i int64) (mark int, rev string, err error) {
+	var b [entrySize]byte
+	if _, err := x.f.ReadAt(b[:], headerSize+i*entrySize); err != nil {
+		return 0, "", err
+	}
+	mark = int(binary.LittleEndian.Uint64(b[0:]))
+	offset := int64(binary.LittleEndian.Uint64(b[8:]))
+	length := int64(binary.LittleEndian.Uint64(b[16:]))
+	s := make([]byte, length)
+	if _, err := x.f.ReadAt(s, x.strings+offset); err != nil {
+		return 0, "", err
+	}
+	return mark, string(s), nil
+}
+
+// Read i-th entry in the revision order
+func (x *Index) entryByRev(i int64) (mark int, rev string, err error) {
+	var b [byRevSize]byte
+	if _, err := x.f.ReadAt(b[:], headerSize+x.n*entrySize+i*byRevSize); err != nil {
+		return 0, "", err
+	}
+	return x.entry(int64(binary.LittleEndian.Uint32(b[:])))
+}
+
+// Find revision with the given mark
+func (x *Index) Rev(mark int) (rev string, ok bool, err error) {
+	lo, hi := int64(0), x.n
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		m, r, err := x.entry(mid)
+		if err != nil {
+			return "", false, err
+		}
+		switch {
+		case m == mark:
+			return r, true, nil
+		case m < mark:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return "", false, nil
+}
+
+// Find mark of the revision
+func (x *Index) Mark(rev string) (mark int, ok bool, err error) {
+	lo, hi := int64(0), x.n
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		m, r, err := x.entryByRev(mid)
+		if err != nil {
+			return 0, false, err
+		}
+		switch {
+		case r == rev:
+			return m, true, nil
+		case r < rev:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false, nil
+}
+
+// Find revision of the other index which has the same mark as rev
+func (x *Index) Translate(rev string, other *Index) (string, bool, error) {
+	mark, ok, err := x.Mark(rev)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	return other.Rev(mark)
+}
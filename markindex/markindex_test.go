@@ -0,0 +1,339 @@
+package markindex
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempMarks(t testing.TB, content string) string {
+	dir, err := ioutil.TempDir("", "markindex_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.marks")
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookup(t *testing.T) {
+	path := tempMarks(t, ":3 ccc\n:1 bbb\ngarbage\n:2 aaa\n:x yyy\n:4 ddd\n:4 eee\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	x, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	if x.Len() != 4 {
+		t.Errorf("Wrong number of marks: %d", x.Len())
+	}
+
+	for mark, want := range map[int]string{1: "bbb", 2: "aaa", 3: "ccc", 4: "eee", 0: "", 5: ""} {
+		rev, ok, err := x.Rev(mark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev != want || ok != (want != "") {
+			t.Errorf("Rev(%d) = %q, %v, want %q", mark, rev, ok, want)
+		}
+	}
+	for rev, want := range map[string]int{"aaa": 2, "bbb": 1, "ccc": 3, "eee": 4, "ddd": 0, "zzz": 0, "": 0} {
+		mark, ok, err := x.Mark(rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mark != want || ok != (want != 0) {
+			t.Errorf("Mark(%q) = %d, %v, want %d", rev, mark, ok, want)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	bzr := tempMarks(t, ":1 rev-1\n:2 rev-2\n:3 rev-3\n")
+	defer os.RemoveAll(filepath.Dir(bzr))
+	git := tempMarks(t, ":1 sha-1\n:3 sha-3\n")
+	defer os.RemoveAll(filepath.Dir(git))
+
+	b, err := Open(bzr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	g, err := Open(git)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if r, ok, err := g.Translate("sha-3", b); r != "rev-3" || !ok || err != nil {
+		t.Errorf("Translate(sha-3) = %q, %v, %v", r, ok, err)
+	}
+	if r, ok, err := b.Translate("rev-2", g); ok || err != nil {
+		t.Errorf("Translate(rev-2) = %q, %v, %v", r, ok, err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	path := tempMarks(t, ":1 aaa\n")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	x, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.Close()
+
+	// marks files are always replaced, so mtime changes even if size doesn't
+	if err := ioutil.WriteFile(path, []byte(":1 bbb\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	x, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	if rev, _, _ := x.Rev(1); rev != "bbb" {
+		t.Errorf("Index wasn't rebuilt, mark 1 is %q", rev)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	base := tempMarks(t, ":2 bbb\n:1 ddd\n")
+	defer os.RemoveAll(filepath.Dir(base))
+	path := filepath.Join(filepath.Dir(base), "new.marks")
+
+	tests := []struct {
+		name, content string
+		marks         map[string]int
+	}{
+		{"new marks", ":4 aaa\n:1 ddd\n:3 eee\n:2 bbb\n",
+			map[string]int{"aaa": 4, "bbb": 2, "ddd": 1, "eee": 3}},
+		{"nothing new", ":1 ddd\n:2 bbb\n",
+			map[string]int{"bbb": 2, "ddd": 1}},
+		{"removed mark", ":2 bbb\n:3 ccc\n",
+			map[string]int{"bbb": 2, "ccc": 3, "ddd": 0}},
+		{"changed mark", ":1 aaa\n:2 bbb\n:3 ccc\n",
+			map[string]int{"aaa": 1, "bbb": 2, "ccc": 3, "ddd": 0}},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := Update(path, base); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		x, err := openIndex(path+IndexSuffix, mustStat(t, path))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if want := len(strings.Split(strings.TrimSpace(tt.content), "\n")); x.Len() != want {
+			t.Errorf("%s: wrong number of marks %d, want %d", tt.name, x.Len(), want)
+		}
+		for rev, want := range tt.marks {
+			mark, ok, err := x.Mark(rev)
+			if err != nil || mark != want || ok != (want != 0) {
+				t.Errorf("%s: Mark(%q) = %d, %v, %v, want %d", tt.name, rev, mark, ok, err, want)
+			}
+			if want == 0 {
+				continue
+			}
+			if r, _, err := x.Rev(want); r != rev || err != nil {
+				t.Errorf("%s: Rev(%d) = %q, %v, want %q", tt.name, want, r, err, rev)
+			}
+		}
+		x.Close()
+	}
+
+	// without the old marks file index is built from scratch
+	if err := Update(path, base+".missing"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openIndex(path+IndexSuffix, mustStat(t, path)); err != nil {
+		t.Error(err)
+	}
+}
+
+func mustStat(t *testing.T, path string) os.FileInfo {
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestEmpty(t *testing.T) {
+	path := tempMarks(t, "")
+	defer os.RemoveAll(filepath.Dir(path))
+
+	x, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+	if _, ok, err := x.Rev(1); ok || err != nil {
+		t.Errorf("Found mark in the empty index: %v, %v", ok, err)
+	}
+	if _, ok, err := x.Mark("aaa"); ok || err != nil {
+		t.Errorf("Found revision in the empty index: %v, %v", ok, err)
+	}
+}
+
+const benchMarks = 200000
+
+// Number of marks added by a typical import
+const benchNewMarks = 100
+
+// Marks file looking like git marks of a big repository
+func benchMarksFile(b *testing.B) string {
+	var sb strings.Builder
+	for i := 1; i <= benchMarks; i++ {
+		fmt.Fprintf(&sb, ":%d %040x\n", i, i*7919)
+	}
+	return tempMarks(b, sb.String())
+}
+
+// Copy of the marks file at path with new marks added by an import
+func benchExtendedMarks(b *testing.B, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var sb strings.Builder
+	sb.Write(data)
+	for i := benchMarks + 1; i <= benchMarks+benchNewMarks; i++ {
+		fmt.Fprintf(&sb, ":%d %040x\n", i, i*7919)
+	}
+	ext := path + ".new"
+	if err := ioutil.WriteFile(ext, []byte(sb.String()), 0666); err != nil {
+		b.Fatal(err)
+	}
+	return ext
+}
+
+// Lookup of the new revision right after the import changed marks file,
+// when index is rebuilt by Open
+func BenchmarkRebuildLookup(b *testing.B) {
+	path := benchMarksFile(b)
+	defer os.RemoveAll(filepath.Dir(path))
+	ext := benchExtendedMarks(b, path)
+	want := fmt.Sprintf("%040x", (benchMarks+1)*7919)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		os.Remove(ext + IndexSuffix)
+		x, err := Open(ext)
+		if err != nil {
+			b.Fatal(err)
+		}
+		mark, _, err := x.Mark(want)
+		x.Close()
+		if err != nil || mark != benchMarks+1 {
+			b.Fatal("Wrong lookup result: ", err)
+		}
+	}
+}
+
+// Same as BenchmarkRebuildLookup, but index is updated from the old one
+// when finalizing the import, as the bridge does
+func BenchmarkUpdateLookup(b *testing.B) {
+	path := benchMarksFile(b)
+	defer os.RemoveAll(filepath.Dir(path))
+	if err := Build(path); err != nil {
+		b.Fatal(err)
+	}
+	ext := benchExtendedMarks(b, path)
+	want := fmt.Sprintf("%040x", (benchMarks+1)*7919)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := Update(ext, path); err != nil {
+			b.Fatal(err)
+		}
+		x, err := Open(ext)
+		if err != nil {
+			b.Fatal(err)
+		}
+		mark, _, err := x.Mark(want)
+		x.Close()
+		if err != nil || mark != benchMarks+1 {
+			b.Fatal("Wrong lookup result: ", err)
+		}
+	}
+}
+
+// Loading whole marks file into maps, as the bridge did for every lookup
+func BenchmarkLoadText(b *testing.B) {
+	path := benchMarksFile(b)
+	defer os.RemoveAll(filepath.Dir(path))
+	want := fmt.Sprintf("%040x", 12345*7919)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f, err := os.Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		byMark := make(map[int]string)
+		byRev := make(map[string]int)
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Split(s.Text(), " ")
+			mark, _ := strconv.Atoi(fields[0][1:])
+			byMark[mark] = fields[1]
+			byRev[fields[1]] = mark
+		}
+		f.Close()
+		if byRev[want] != 12345 {
+			b.Fatal("Wrong lookup result")
+		}
+	}
+}
+
+// Opening already built index and looking up a revision
+func BenchmarkIndexLookup(b *testing.B) {
+	path := benchMarksFile(b)
+	defer os.RemoveAll(filepath.Dir(path))
+	if err := Build(path); err != nil {
+		b.Fatal(err)
+	}
+	want := fmt.Sprintf("%040x", 12345*7919)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		x, err := Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		mark, _, err := x.Mark(want)
+		x.Close()
+		if err != nil || mark != 12345 {
+			b.Fatal("Wrong lookup result: ", err)
+		}
+	}
+}
+
+// Building index after the marks file was changed
+func BenchmarkBuild(b *testing.B) {
+	path := benchMarksFile(b)
+	defer os.RemoveAll(filepath.Dir(path))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := Build(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/fastimport"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// If enabled in the bridge config, every commit imported from bzr gets a git
+// note with its bzr revision id and revno. Notes are kept in notesRef, which
+// is updated in the same transaction as the branch.
+const notesRef = "refs/notes/bzr"
+
+// Temporary reference used while creating new notes commit
+const tmpNotesRef = "refs/git-bzr-bridge/notes-tmp"
+
+// Text of the note for the commit
+func bzrNote(revid, revno, gitBranch string) []byte {
+	return []byte(fmt.Sprintf("revision-id: %s\nrevno: %s\nbranch: %s\n", revid, revno, gitBranch))
+}
+
+// Parse note created by bzrNote, missing fields are left empty
+func parseBzrNote(note string) (revid, revno, gitBranch string) {
+	for _, line := range strings.Split(note, "\n") {
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			continue
+		}
+		switch v := line[i+2:]; line[:i] {
+		case "revision-id":
+			revid = v
+		case "revno":
+			revno = v
+		case "branch":
+			gitBranch = v
+		}
+	}
+	return
+}
+
+// Note which has to be attached to a git commit
+type pendingNote struct {
+	Commit, Note string
+}
+
+// Notes of the commits which were exported by the pre-receive hook. Git
+// doesn't allow updating references until the push is accepted, so they are
+// saved into pendingNotesName and added by the post-receive hook.
+var pushedNotes []*pendingNote
+
+var pendingNotesName = filepath.Join(tmpDir, "pending-notes")
+
+// Journal step attaching notes to the commits which were just imported from
+// the bzr branch at path. Returns nil if notes are disabled or there is nothing
+// new. Caller must hold repository lock.
+func notesStep(tmpGitMarks, tmpBzrMarks, path, gitBranch string) *journalStep {
+	return notesCommitStep(newNotes(tmpGitMarks, tmpBzrMarks, path, gitBranch), gitBranch)
+}
+
+// Notes for the revisions which are in the new marks files, but not in the
+// current ones. Returns nil if notes are disabled. Caller must hold repository lock.
+func newNotes(tmpGitMarks, tmpBzrMarks, path, gitBranch string) []*pendingNote {
+	bc, err := loadBridgeConfig()
+	must(err)
+	if !bc.Notes {
+		return nil
+	}
+
+	// only the new marks files are parsed, old revisions are looked up
+	// in the index
+	mi := openMarksIndex()
+	defer mi.Close()
+	bm, err := loadMarks(tmpBzrMarks)
+	must(err)
+	gm, err := loadMarks(tmpGitMarks)
+	must(err)
+	commits := make(map[string]string)
+	var revids []string
+	for revid, mark := range bm.byRev {
+		if _, ok := markOf(mi.bzr, revid); ok {
+			continue
+		}
+		if commit, ok := gm.byMark[mark]; ok {
+			commits[revid] = commit
+			revids = append(revids, revid)
+		}
+	}
+	if len(revids) == 0 {
+		return nil
+	}
+	sort.Strings(revids)
+
+	revnos, err := bzr.RevisionNumbers(path, revids)
+	must(err)
+	var notes []*pendingNote
+	for _, revid := range revids {
+		notes = append(notes, &pendingNote{commits[revid], string(bzrNote(revid, revnos[revid], gitBranch))})
+	}
+	return notes
+}
+
+// Journal step adding the notes to notesRef, nil if there are none.
+// Caller must hold repository lock.
+func notesCommitStep(notes []*pendingNote, what string) *journalStep {
+	if len(notes) == 0 {
+		return nil
+	}
+	log.Infof("Adding notes to %d commits", len(notes))
+	oldNotes, err := git.ResolveRef(notesRef)
+	must(err)
+
+	c := &fastimport.Commit{
+		Ref: tmpNotesRef,
+		Committer: &fastimport.Ident{
+			Name:  "git-bzr-bridge",
+			Email: "git-bzr-bridge@localhost",
+			When:  fmt.Sprintf("%d +0000", time.Now().Unix()),
+		},
+		Message: []byte("Notes for " + what + "\n"),
+		From:    oldNotes,
+	}
+	for _, n := range notes {
+		c.Files = append(c.Files, &fastimport.FileCommand{
+			Op:      fastimport.NoteModify,
+			DataRef: "inline",
+			Path:    n.Commit,
+			Data:    []byte(n.Note),
+		})
+	}
+	var stream bytes.Buffer
+	w := fastimport.NewWriter(&stream)
+	must(w.Write(c))
+	must(w.Flush())
+
+	git.DeleteRef(tmpNotesRef)
+	must(git.FastImport(&stream))
+	commit, err := git.ResolveRef(tmpNotesRef)
+	must(err)
+	must(git.DeleteRef(tmpNotesRef))
+	return &journalStep{Op: stepSetRef, From: commit, To: notesRef}
+}
+
+// Save notes of the accepted push for flushPendingNotes.
+// Caller must hold repository lock.
+func savePendingNotes(notes []*pendingNote) error {
+	if len(notes) == 0 {
+		return nil
+	}
+	all, err := loadPendingNotes()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(append(all, notes...), "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pendingNotesName, data)
+}
+
+func loadPendingNotes() ([]*pendingNote, error) {
+	data, err := ioutil.ReadFile(pendingNotesName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var notes []*pendingNote
+	if err := json.Unmarshal(data, &notes); err != nil {
+		return nil, fmt.Errorf("%s: %s", pendingNotesName, err)
+	}
+	return notes, nil
+}
+
+// Add notes saved by the pre-receive hook. Commits which didn't make it
+// into the repository (e.g. push failed after the hook) are skipped.
+// Caller must hold repository lock.
+func flushPendingNotes() {
+	notes, err := loadPendingNotes()
+	must(err)
+	if len(notes) == 0 {
+		return
+	}
+	var commits []string
+	for _, n := range notes {
+		commits = append(commits, n.Commit)
+	}
+	types, err := git.ObjectTypes(commits)
+	must(err)
+	var present []*pendingNote
+	for _, n := range notes {
+		if types[n.Commit] == "commit" {
+			present = append(present, n)
+		}
+	}
+	if s := notesCommitStep(present, "pushed commits"); s != nil {
+		runJournal(&journal{Steps: []*journalStep{s}})
+	}
+	must(os.Remove(pendingNotesName))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func postReceiveHookCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("post-receive-hook", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	fs.Usage = func() { postReceiveHookUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	updates, err := readRefUpdates()
+	must(err)
+
+	bridgeConfig, err := loadBridgeConfig()
+	must(err)
+	if bridgeConfig.Async {
+		must(enqueue(updates))
+		return
+	}
+	finishPreReceive(updates)
+}
+
+// Do what pre-receive hook couldn't do because git doesn't allow changing
+// references until the push is accepted: delete branches and add notes
+func finishPreReceive(updates []*refUpdate) {
+	c, err := loadBranchConfig()
+	must(err)
+	for _, u := range updates {
+		if u.new != emptyRef || !strings.HasPrefix(u.ref, "refs/heads/") {
+			continue
+		}
+		// with update hook the branch is already gone
+		if b, ok := c.byGitName[pushedBranchName(u.ref)]; ok && !b.Frozen {
+			deleteBranch(b, u.old)
+		}
+	}
+
+	lk := lockRepo()
+	defer lk.Release()
+	flushPendingNotes()
+}
+
+func postReceiveHookUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge post-receive-hook [-h]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+post-receive-hook should be called from the git post-receive hook when
+asynchronous mode is enabled in ` + bridgeConfigName + ` or pre-receive-hook
+is used. It reads "<old obj> <new obj> <ref name>" lines from stdin.
+
+In asynchronous mode it puts them into the queue, which is processed later by
+the worker command, and update-hook and pre-receive-hook only validate pushes
+without exporting anything into bzr.
+
+Otherwise it finishes the push accepted by pre-receive-hook: deletes branches
+according to their OnDelete policy and adds git notes of the pushed commits.
+`)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Single reference update as received by the pre-receive hook
+type refUpdate struct {
+	old, new, ref string
+}
+
+func preReceiveHookCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("pre-receive-hook", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	fs.Usage = func() { preReceiveHookUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	updates, err := readRefUpdates()
+	must(err)
+
+	branchConfig, err := loadBranchConfig()
+	must(err)
+	bridgeConfig, err := loadBridgeConfig()
+	must(err)
+
+	// new tips of the pushed branches, git refs aren't updated until we finish
+	tips := make(map[string]string)
+	for _, u := range updates {
+		if strings.HasPrefix(u.ref, "refs/heads/") && u.new != emptyRef {
+			tips[pushedBranchName(u.ref)] = u.new
+		}
+	}
+
+	// check everything before pushing anything into bzr
+	failed := false
+	for _, u := range updates {
+		if err := checkRefUpdate(branchConfig, bridgeConfig, u, tips); err != nil {
+			log.Errorf("%s: %s", u.ref, err)
+			failed = true
+		}
+	}
+	if failed {
+		panic(fmt.Errorf("Push rejected"))
+	}
+	if bridgeConfig.Async {
+		// export will be done later from the queue
+		return
+	}
+
+	// tags can point to commits which are exported by the push of their branch
+	sort.SliceStable(updates, func(i, j int) bool {
+		return !strings.HasPrefix(updates[i].ref, "refs/tags/") && strings.HasPrefix(updates[j].ref, "refs/tags/")
+	})
+
+	// updated branches and their previous bzr tips
+	var done branchList
+	var oldTips []string
+	for _, u := range updates {
+		b, oldTip := branchUpdateInfo(branchConfig, u)
+		err := capture(func() { handleRefUpdate(branchConfig, u.ref, u.old, u.new, tips) })
+		if err != nil {
+			log.Errorf("%s: %s", u.ref, err)
+			rollbackPush(done, oldTips, updates)
+			panic(fmt.Errorf("Push rejected"))
+		}
+		if b != nil {
+			done = append(done, b)
+			oldTips = append(oldTips, oldTip)
+		}
+	}
+
+	lk := lockRepo()
+	defer lk.Release()
+	must(savePendingNotes(pushedNotes))
+}
+
+func readRefUpdates() ([]*refUpdate, error) {
+	var updates []*refUpdate
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("Invalid input line %q", s.Text())
+		}
+		updates = append(updates, &refUpdate{f[0], f[1], f[2]})
+	}
+	return updates, s.Err()
+}
+
+// Check whether reference update can be bridged without actually
+// pushing anything into bzr. See handleRefUpdate for tips.
+func checkRefUpdate(c *branchConfig, bc *bridgeConfig, u *refUpdate, tips map[string]string) error {
+	return capture(func() {
+		if candidates := tagBranches(c, u.ref); len(candidates) != 0 {
+			checkTagPush(candidates, u.ref, u.old, u.new, tips)
+			return
+		}
+
+		gitBranch := pushedBranchName(u.ref)
+		if u.old == emptyRef {
+			if bc.newBranch(gitBranch) == nil {
+				panic(fmt.Errorf("Creation of new references is not supported: %q doesn't match any url template", gitBranch))
+			}
+			return
+		}
+
+		b, ok := c.byGitName[gitBranch]
+		if !ok {
+			panic(fmt.Errorf("Unknown branch %q", gitBranch))
+		}
+		if u.new == emptyRef {
+			must(b.checkMirror())
+			if b.OnDelete != deleteUnregister && b.OnDelete != deleteArchive {
+				panic(fmt.Errorf("Deletion of branch %q is not allowed", b.Git))
+			}
+			return
+		}
+
+		lk := lockBranch(b.Git)
+		defer lk.Release()
+		checkBranchPush(b, u.old, u.new)
+	})
+}
+
+// If u is a push into existing branch, return the branch
+// and its current bzr tip
+func branchUpdateInfo(c *branchConfig, u *refUpdate) (*branchInfo, string) {
+	if u.old == emptyRef || u.new == emptyRef || !strings.HasPrefix(u.ref, "refs/heads/") {
+		return nil, ""
+	}
+	b, ok := c.byGitName[pushedBranchName(u.ref)]
+	if !ok {
+		return nil, ""
+	}
+	tip, err := bzr.Tip(b.Bzr)
+	must(err)
+	return b, tip
+}
+
+// Restore previous state of the branches after failed push: reset hidden bzr
+// branches to their old tips, drop marks of the pushed commits (git will
+// discard them) and overwrite upstream bzr branches.
+func rollbackPush(done branchList, oldTips []string, updates []*refUpdate) {
+	if len(done) == 0 {
+		return
+	}
+	err := capture(func() {
+		// always take locks in the same order to avoid deadlocks
+		locked := append(branchList(nil), done...)
+		sort.Slice(locked, func(i, j int) bool { return locked[i].Git < locked[j].Git })
+		for _, b := range locked {
+			lk := lockBranch(b.Git)
+			defer lk.Release()
+		}
+		repoLk := lockRepo()
+		defer repoLk.Release()
+
+		j := &journal{}
+		for i, b := range done {
+			j.Steps = append(j.Steps, &journalStep{Op: stepBzrReset, From: oldTips[i], To: b.Bzr})
+		}
+		if steps, files := dropPushedMarks(updates); steps != nil {
+			j.Steps = append(j.Steps, steps...)
+			j.CleanupFiles = files
+		}
+		log.Info("Rolling back hidden bzr branches and marks")
+		runJournal(j)
+
+		for i := len(done) - 1; i >= 0; i-- {
+			log.Infof("Rolling back %q to %s", done[i].Url, oldTips[i])
+			must(bzr.PushOverwrite(done[i].Bzr, done[i].Url))
+		}
+	})
+	if err != nil {
+		log.Errorf("Can't roll back the push: %s", err)
+	}
+}
+
+// Journal steps removing marks of the commits which are being pushed,
+// or nil if there are none. Caller must hold repository lock.
+func dropPushedMarks(updates []*refUpdate) ([]*journalStep, []string) {
+	var revs []string
+	for _, u := range updates {
+		if u.new != emptyRef {
+			revs = append(revs, u.new)
+		}
+	}
+	commits, err := git.NewCommits(revs)
+	must(err)
+
+	// usually none of them are marked, so check the index before
+	// parsing whole marks files
+	mi := openMarksIndex()
+	marked := false
+	for _, commit := range commits {
+		if _, ok := markOf(mi.git, commit); ok {
+			marked = true
+			break
+		}
+	}
+	mi.Close()
+	if !marked {
+		return nil, nil
+	}
+
+	bm, err := loadMarks(bzrMarks)
+	must(err)
+	gm, err := loadMarks(gitMarks)
+	must(err)
+	dropped := 0
+	for _, commit := range commits {
+		if mark, ok := gm.byRev[commit]; ok {
+			delete(gm.byRev, commit)
+			delete(gm.byMark, mark)
+			if revid, ok := bm.byMark[mark]; ok {
+				delete(bm.byRev, revid)
+				delete(bm.byMark, mark)
+			}
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return nil, nil
+	}
+	log.Infof("Removing %d pushed commits from the marks files", dropped)
+	tmpBzrMarks := filepath.Join(tmpDir, "rollback-bzr.marks")
+	tmpGitMarks := filepath.Join(tmpDir, "rollback-git.marks")
+	must(writeMarks(tmpBzrMarks, bm))
+	must(writeMarks(tmpGitMarks, gm))
+	return marksSteps(tmpGitMarks, tmpBzrMarks), []string{tmpGitMarks, tmpBzrMarks}
+}
+
+func preReceiveHookUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge pre-receive-hook [-h]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+pre-receive-hook should be called from the git pre-receive hook instead of
+update-hook. It reads "<old obj> <new obj> <ref name>" lines from stdin
+and will accept either all of the references or none of them.
+
+All the references are checked first (known branches, fast-forward, bzr branches
+haven't diverged, tags can be bridged) and only then pushed into bzr, branches
+first. If push of one of the references fails, bzr branches which were already
+pushed are rolled back to their previous state together with the marks files.
+Creation of new branches and tags can't be rolled back.
+
+Git doesn't allow changing references from the pre-receive hook, so deleted
+branches and git notes of the pushed commits are handled by the post-receive
+hook (install-hooks -pre-receive installs both of them), and new bzr revisions
+of diverged branches aren't imported until the next update.
+`)
+}
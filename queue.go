@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/lock"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// In asynchronous mode pushes are only validated by the hooks, and actual
+// export into bzr is done later by the worker. Jobs are kept as separate
+// files in the queue directory, and their names define the order.
+
+const jobSuffix = ".job"
+
+var workerLockName = filepath.Join(queueDir, "worker.lock")
+
+type queueJob struct {
+	Id            string `json:"-"`
+	Ref, Old, New string
+	Created       time.Time
+	Attempts      int
+	LastError     string `json:",omitempty"`
+	// failed too many times and won't be retried automatically
+	Failed bool `json:",omitempty"`
+}
+
+func (j *queueJob) path() string {
+	return filepath.Join(queueDir, j.Id+jobSuffix)
+}
+
+func (j *queueJob) save() error {
+	data, err := json.MarshalIndent(j, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(j.path(), data)
+}
+
+func (j *queueJob) state() string {
+	switch {
+	case j.Failed:
+		return "failed"
+	case j.Attempts > 0:
+		return "retrying"
+	}
+	return "pending"
+}
+
+// Add reference updates to the end of the queue
+func enqueue(updates []*refUpdate) error {
+	if err := os.MkdirAll(queueDir, 0777); err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, u := range updates {
+		j := &queueJob{
+			Id:      fmt.Sprintf("%020d-%04d", now.UnixNano(), i),
+			Ref:     u.ref,
+			Old:     u.old,
+			New:     u.new,
+			Created: now,
+		}
+		if err := j.save(); err != nil {
+			return err
+		}
+		log.Infof("Queued %s for export into bzr", u.ref)
+	}
+	return nil
+}
+
+// Load all jobs from the queue in order
+func loadQueue() ([]*queueJob, error) {
+	files, err := ioutil.ReadDir(queueDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*queueJob
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), jobSuffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(queueDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		j := new(queueJob)
+		if err := json.Unmarshal(data, j); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name(), err)
+		}
+		j.Id = strings.TrimSuffix(f.Name(), jobSuffix)
+		jobs = append(jobs, j)
+	}
+	sort.Sort(byJobId(jobs))
+	return jobs, nil
+}
+
+type byJobId []*queueJob
+
+func (x byJobId) Less(i, j int) bool { return x[i].Id < x[j].Id }
+func (x byJobId) Len() int           { return len(x) }
+func (x byJobId) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+// Process all jobs in the queue. Returns false if some of them failed.
+func drainQueue(maxAttempts int) bool {
+	lk, err := lock.Acquire(workerLockName, 0)
+	if _, ok := err.(*lock.TimeoutError); ok {
+		log.Info("Another worker is already running")
+		return true
+	}
+	must(err)
+	defer lk.Release()
+
+	jobs, err := loadQueue()
+	must(err)
+
+	ok := true
+	// references with earlier jobs still waiting or failed -- later jobs must
+	// wait too, so that older revisions won't be pushed over newer ones
+	blocked := make(map[string]bool)
+	for _, j := range jobs {
+		if j.Failed {
+			blocked[j.Ref] = true
+			continue
+		}
+		if blocked[j.Ref] {
+			log.Infof("Job %s: waiting for earlier jobs of %s", j.Id, j.Ref)
+			continue
+		}
+
+		log.Infof("Job %s: exporting %s", j.Id, j.Ref)
+		c, err := loadBranchConfig()
+		must(err)
+		err = capture(func() { runQueuedUpdate(c, j) })
+		if err == nil {
+			must(os.Remove(j.path()))
+			continue
+		}
+
+		ok = false
+		j.Attempts++
+		j.LastError = err.Error()
+		if j.Attempts >= maxAttempts {
+			j.Failed = true
+			log.Errorf("Job %s: giving up after %d attempts: %s", j.Id, j.Attempts, err)
+		} else {
+			log.Errorf("Job %s: %s", j.Id, err)
+		}
+		blocked[j.Ref] = true
+		must(j.save())
+	}
+	return ok
+}
+
+// Export queued reference update into bzr
+func runQueuedUpdate(c *branchConfig, j *queueJob) {
+	b, _ := branchUpdateInfo(c, &refUpdate{j.Old, j.New, j.Ref})
+	if b == nil {
+		// tags, creation and deletion of branches don't touch git side
+		handleRefUpdate(c, j.Ref, j.Old, j.New, nil)
+		return
+	}
+
+	// git branch is already updated, so we can't import new bzr revisions
+	// on top of it like update-hook does
+	lk := lockBranch(b.Git)
+	defer lk.Release()
+	upToDate, err := isUpToDate(b.Bzr, b.Url)
+	must(err)
+	if !upToDate && b.mode() == modePush {
+		panic(pushOnlyDiverged(b))
+	}
+	if !upToDate {
+		panic(fmt.Errorf("These branches have diverged"))
+	}
+	exportGitImportBzrAndPush(j.Old, j.New, b)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func queueCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	retry := fs.Bool("retry", false, "put failed jobs back into the queue")
+	fs.Usage = func() { queueUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	jobs, err := loadQueue()
+	must(err)
+
+	for _, j := range jobs {
+		if *retry && j.Failed {
+			j.Failed = false
+			j.Attempts = 0
+			must(j.save())
+		}
+		fmt.Printf("%s  %-8s  %s %s..%s\n", j.Id, j.state(), j.Ref, j.Old, j.New)
+		if j.LastError != "" {
+			fmt.Printf("    attempts: %d, last error: %s\n", j.Attempts, j.LastError)
+		}
+	}
+}
+
+func queueUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge queue [-h] [-retry]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+queue will list pushes waiting to be exported into bzr by the worker,
+together with the failed ones. With -retry failed jobs are put back
+into the queue and will be retried by the next run of the worker.
+
+Failed job blocks all later pushes of the same reference, so that they are
+never exported out of order.
+`)
+}
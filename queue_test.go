@@ -0,0 +1,158 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Create bridge directory with a git repo containing branch b and chdir
+// into it until the end of the test. Returns tip of the branch.
+func setupBridge(t *testing.T, b *branchInfo) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := git.InitRepo("."); err != nil {
+		t.Skip("git isn't available: ", err)
+	}
+	stream := "commit refs/heads/" + b.Git + "\n" +
+		"committer A <a@example.com> 1000000000 +0000\ndata 4\ntest\n" +
+		"M 644 inline file\ndata 5\nfile\n\n"
+	if err := git.FastImport(strings.NewReader(stream)); err != nil {
+		t.Fatal(err)
+	}
+	tip, err := git.ResolveRef("refs/heads/" + b.Git)
+	if err != nil || tip == "" {
+		t.Fatal("Can't create git branch: ", err)
+	}
+
+	data, err := json.Marshal([]*branchInfo{b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		branchConfigName: data,
+		bzrMarks:         nil,
+		gitMarks:         nil,
+	} {
+		if err := ioutil.WriteFile(name, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{tmpDir, b.Bzr} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tip
+}
+
+// Queued jobs run after git has already deleted the branch
+func TestQueuedBranchDeletion(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't available")
+	}
+
+	for _, policy := range []string{deleteArchive, deleteUnregister} {
+		t.Run(policy, func(t *testing.T) {
+			b := &branchInfo{Url: "lp:feature", Bzr: filepath.Join(bzrRepo, "feature"), Git: "feature", OnDelete: policy}
+			tip := setupBridge(t, b)
+
+			if err := git.DeleteRef("refs/heads/feature"); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadBranchConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			j := &queueJob{Ref: "refs/heads/feature", Old: tip, New: emptyRef}
+			if err := capture(func() { runQueuedUpdate(c, j) }); err != nil {
+				t.Fatalf("queued deletion failed: %s", err)
+			}
+
+			out, err := exec.Command("git", "for-each-ref", "--format=%(objectname)", removedRefsPrefix).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(out)) != tip {
+				t.Errorf("commits of the deleted branch weren't kept: %q", out)
+			}
+
+			c, err = loadBranchConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch policy {
+			case deleteArchive:
+				if nb := c.byGitName["feature"]; nb == nil || !nb.Frozen {
+					t.Errorf("branch isn't frozen: %+v", nb)
+				}
+			case deleteUnregister:
+				if c.byGitName["feature"] != nil {
+					t.Error("branch is still in the config")
+				}
+				if exists(b.Bzr) {
+					t.Error("hidden bzr branch wasn't removed")
+				}
+			}
+		})
+	}
+}
+
+// Jobs queued after the failed one must wait for it
+func TestFailedJobBlocksLaterOnes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't available")
+	}
+	b := &branchInfo{Url: "lp:feature", Bzr: filepath.Join(bzrRepo, "feature"), Git: "feature", OnDelete: deleteArchive}
+	tip := setupBridge(t, b)
+	if err := git.DeleteRef("refs/heads/feature"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(queueDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	jobs := []*queueJob{
+		{Id: "1", Ref: "refs/heads/feature", Old: emptyRef, New: tip, Failed: true},
+		{Id: "2", Ref: "refs/heads/feature", Old: tip, New: emptyRef},
+	}
+	for _, j := range jobs {
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := capture(func() { drainQueue(5) }); err != nil {
+		t.Fatal(err)
+	}
+	left, err := loadQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[1].Attempts != 0 {
+		t.Errorf("later job wasn't blocked: %+v", left)
+	}
+	c, err := loadBranchConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nb := c.byGitName["feature"]; nb == nil || nb.Frozen {
+		t.Errorf("later job was run: %+v", nb)
+	}
+}
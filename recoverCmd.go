@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func recoverCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	fs.Usage = func() { recoverUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	report, err := recoverJournal()
+	must(err)
+	if report == "" {
+		fmt.Println("Nothing to recover")
+	} else {
+		fmt.Println(report)
+	}
+}
+
+func recoverUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge recover [-h]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+recover will look for import or push which was interrupted half-way
+through finalisation and will either finish it (if all the temporary
+data is still there) or roll it back. It will report what was done.
+
+All other commands do the same automatically before doing anything else.
+`)
+}
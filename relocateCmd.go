@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+
+	"flag"
+	"fmt"
+	"os"
+)
+
+func relocateCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("relocate", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	fs.Usage = func() { relocateUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 2 || fs.Arg(0) == "" || fs.Arg(1) == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	gitBranch, url := fs.Arg(0), fs.Arg(1)
+	lk := lockBranch(gitBranch)
+	defer lk.Release()
+
+	c, err := loadBranchConfig()
+	must(err)
+	old, ok := c.byGitName[gitBranch]
+	if !ok {
+		panic(fmt.Errorf("Unknown branch %q", gitBranch))
+	}
+	b := *old
+	b.Url = url
+	arr, err := c.replaced(gitBranch, &b)
+	must(err)
+	_, err = newBranchConfig(arr)
+	must(err)
+
+	// new location must contain everything we have already imported
+	log.Infof("Checking history of %q", url)
+	tip, err := bzr.Tip(old.Bzr)
+	must(err)
+	ok, err = bzr.Contains(url, old.Bzr)
+	must(err)
+	if !ok {
+		panic(fmt.Errorf("%q doesn't contain revision %s", url, tip))
+	}
+
+	repoLk := lockRepo()
+	defer repoLk.Release()
+
+	log.Infof("Relocating %q from %q to %q", gitBranch, old.Url, url)
+	runJournal(&journal{
+		Steps: []*journalStep{{Op: stepSetBranch, Prev: old, Branch: &b}},
+	})
+}
+
+func relocateUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge relocate [-h] <branch> <url>")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+relocate will change upstream location of the bzr branch imported as <branch>
+to <url>. The branch at the new location must contain all the revisions
+which were already imported.
+`)
+}
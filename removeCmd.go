@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Removed git branches are kept under this prefix, so that commits
+// referenced from the marks files aren't garbage-collected
+const removedRefsPrefix = "refs/git-bzr-bridge/removed/"
+
+func removeCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	keepGit := fs.Bool("keep-git", false, "don't delete git branch")
+	keepBzr := fs.Bool("keep-bzr", false, "don't delete hidden bzr branch")
+	fs.Usage = func() { removeUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	gitBranch := fs.Arg(0)
+	lk := lockBranch(gitBranch)
+	defer lk.Release()
+
+	c, err := loadBranchConfig()
+	must(err)
+	b, ok := c.byGitName[gitBranch]
+	if !ok {
+		panic(fmt.Errorf("Unknown branch %q", gitBranch))
+	}
+
+	repoLk := lockRepo()
+	defer repoLk.Release()
+
+	log.Infof("Removing %q", gitBranch)
+	var keep *journalStep
+	if !*keepGit {
+		keep = keepCommitsStep(b, "")
+	}
+	runJournal(removeBranchJournal(b, keep, *keepBzr))
+}
+
+// Transaction removing the branch from config and optionally deleting hidden
+// bzr branch. keep is a step saving commits of the git branch (see
+// keepCommitsStep), if it's nil the git branch is left as it is.
+func removeBranchJournal(b *branchInfo, keep *journalStep, keepBzr bool) *journal {
+	j := &journal{
+		Steps: []*journalStep{{Op: stepDelBranch, Branch: b}},
+	}
+	if keep != nil {
+		j.Steps = append(j.Steps, keep)
+	}
+	if !keepBzr {
+		// revisions stay in the shared repo, so bzr marks remain valid
+		trash := filepath.Join(tmpDir, tempBranchName())
+		j.Steps = append(j.Steps, &journalStep{Op: stepRenameDir, From: b.Bzr, To: trash})
+		j.CleanupFiles = append(j.CleanupFiles, trash)
+	}
+	return j
+}
+
+// Journal step saving commits of the git branch under removedRefsPrefix.
+// The branch is moved there, or if it was already deleted by push,
+// its old tip oldRev is saved instead.
+func keepCommitsStep(b *branchInfo, oldRev string) *journalStep {
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	to := removedRefsPrefix + b.Git + "/" + stamp
+	if oldRev != "" {
+		return &journalStep{Op: stepSetRef, From: oldRev, To: to}
+	}
+	return &journalStep{Op: stepMoveRef, From: "refs/heads/" + b.Git, To: to}
+}
+
+func removeUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge remove [-h] [-keep-git] [-keep-bzr] <git branch>")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+remove will unregister <git branch> from git-bzr-bridge. Unless told otherwise
+it will also delete the git branch and the hidden bzr branch. Upstream bzr
+branch is never touched.
+
+Commits of the deleted git branch are kept under ` + removedRefsPrefix + `
+to keep the marks files valid.
+`)
+}
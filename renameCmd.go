@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"flag"
+	"fmt"
+	"os"
+)
+
+func renameCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("rename", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	fs.Usage = func() { renameUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 2 || fs.Arg(0) == "" || fs.Arg(1) == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	oldName, newName := fs.Arg(0), fs.Arg(1)
+
+	// always take locks in the same order to avoid deadlocks
+	first, second := oldName, newName
+	if first > second {
+		first, second = second, first
+	}
+	lk1 := lockBranch(first)
+	defer lk1.Release()
+	lk2 := lockBranch(second)
+	defer lk2.Release()
+
+	c, err := loadBranchConfig()
+	must(err)
+	old, ok := c.byGitName[oldName]
+	if !ok {
+		panic(fmt.Errorf("Unknown branch %q", oldName))
+	}
+	b := *old
+	b.Git = newName
+	arr, err := c.replaced(oldName, &b)
+	must(err)
+	_, err = newBranchConfig(arr)
+	must(err)
+	if rev, err := git.ResolveRef("refs/heads/" + newName); err != nil {
+		panic(err)
+	} else if rev != "" {
+		panic(fmt.Errorf("Git branch %q already exists", newName))
+	}
+
+	repoLk := lockRepo()
+	defer repoLk.Release()
+
+	log.Infof("Renaming %q to %q", oldName, newName)
+	runJournal(&journal{
+		Steps: []*journalStep{
+			{Op: stepGitBranch, From: oldName, To: newName},
+			{Op: stepSetBranch, Prev: old, Branch: &b},
+		},
+	})
+}
+
+func renameUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge rename [-h] <old branch> <new branch>")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+rename will rename git branch <old branch> into <new branch> and update
+configuration of git-bzr-bridge accordingly. Bzr branches aren't affected.
+`)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/fastimport"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func repairMarksCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("repair-marks", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	dryRun := fs.Bool("n", false, "only show what would be changed")
+	notesOnly := fs.Bool("notes-only", false, "don't export bzr branches, only use git notes")
+	fs.Usage = func() { repairMarksUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	lk := lockRepo()
+	defer lk.Release()
+
+	c, err := loadBranchConfig()
+	must(err)
+	bm := loadMarksOrEmpty(bzrMarks)
+	gm := loadMarksOrEmpty(gitMarks)
+
+	pairs := notesPairs()
+	log.Infof("Found %d revisions in git notes", len(pairs))
+	if !*notesOnly {
+		matchExportedCommits(c, pairs)
+	}
+
+	conflicts := mergeMarks(bm, gm, pairs)
+	for _, s := range conflicts {
+		log.Error(s)
+	}
+	if len(conflicts) > 0 {
+		log.Errorf("%d conflicts between marks files and repository contents were left as is", len(conflicts))
+	}
+	bzrDiff := marksDiff(bzrMarks, loadMarksOrEmpty(bzrMarks), bm)
+	gitDiff := marksDiff(gitMarks, loadMarksOrEmpty(gitMarks), gm)
+	fmt.Print(bzrDiff, gitDiff)
+	if *dryRun || bzrDiff+gitDiff == "" {
+		return
+	}
+
+	log.Info("Writing new marks files")
+	tmpBzrMarks := filepath.Join(tmpDir, "repaired-bzr.marks")
+	tmpGitMarks := filepath.Join(tmpDir, "repaired-git.marks")
+	must(writeMarks(tmpBzrMarks, bm))
+	must(writeMarks(tmpGitMarks, gm))
+	runJournal(&journal{
+		Steps:        marksSteps(tmpGitMarks, tmpBzrMarks),
+		CleanupFiles: []string{tmpGitMarks, tmpBzrMarks},
+	})
+}
+
+func loadMarksOrEmpty(path string) *marks {
+	m, err := loadMarks(path)
+	if os.IsNotExist(err) {
+		return &marks{byMark: make(map[int]string), byRev: make(map[string]int)}
+	}
+	must(err)
+	return m
+}
+
+func (m *marks) set(mark int, rev string) {
+	m.byMark[mark] = rev
+	m.byRev[rev] = mark
+}
+
+// Pairs of bzr revision and git commit recorded in git notes
+func notesPairs() map[string]string {
+	notes, err := git.Notes(notesRef)
+	must(err)
+	pairs := make(map[string]string)
+	for commit, note := range notes {
+		if revid, _, _ := parseBzrNote(note); revid != "" {
+			pairs[revid] = commit
+		}
+	}
+	return pairs
+}
+
+// Key identifying the commit on both sides of the bridge
+func commitKey(tree, author, authorTime, committer, commitTime, message string) string {
+	return strings.Join([]string{
+		tree,
+		strings.TrimSpace(author), authorTime,
+		strings.TrimSpace(committer), commitTime,
+		strings.TrimSpace(message)}, "\x00")
+}
+
+// Temporary reference for the commits imported from bzr by repair-marks
+const repairRef = "refs/git-bzr-bridge/repair"
+
+// Export all bzr branches and find git commits with the same tree, author,
+// committer, dates and message. Found pairs are added to pairs, ambiguous ones
+// are skipped.
+//
+// To get the trees the exported revisions are imported into git under
+// repairRef. Their objects are mostly already in the repo, and the reference
+// is removed afterwards.
+func matchExportedCommits(c *branchConfig, pairs map[string]string) {
+	log.Info("Reading git commits")
+	must(git.DeleteRef(repairRef))
+	commits, err := git.AllCommits()
+	must(err)
+	byKey := make(map[string][]string)
+	for _, ci := range commits {
+		k := commitKey(ci.Tree, ci.Author, ci.AuthorTime, ci.Committer, ci.CommitTime, ci.Message)
+		byKey[k] = append(byKey[k], ci.Commit)
+	}
+	defer func() { must(git.DeleteRef(repairRef)) }()
+
+	// marks of the previous branches, so that shared history is exported once
+	prevBzrMarks := emptyTempFile("bzr_marks")
+	defer os.Remove(prevBzrMarks)
+	prevGitMarks := emptyTempFile("git_marks")
+	defer os.Remove(prevGitMarks)
+
+	matched, ambiguous, unknown := 0, 0, 0
+	for _, b := range c.branches {
+		log.Infof("Exporting %q", b.Bzr)
+		keys := make(map[string]string) // mark -> key without the tree
+		collect := func(cmd fastimport.Command) (fastimport.Command, error) {
+			switch cmd := cmd.(type) {
+			case *fastimport.Commit:
+				a := cmd.Committer
+				if len(cmd.Authors) > 0 {
+					a = cmd.Authors[0]
+				}
+				keys[cmd.Mark] = commitKey("", identString(a), identTime(a),
+					identString(cmd.Committer), identTime(cmd.Committer), string(cmd.Message))
+				cmd.Ref = repairRef
+			case *fastimport.Reset:
+				cmd.Ref = repairRef
+			}
+			return cmd, nil
+		}
+
+		newBzrMarks, newGitMarks := exportBzrBranch(b, prevBzrMarks, prevGitMarks,
+			append(streamFilters(false), collect))
+		bm, err := loadMarks(newBzrMarks)
+		must(err)
+		gm, err := loadMarks(newGitMarks)
+		must(err)
+		must(os.Rename(newBzrMarks, prevBzrMarks))
+		must(os.Rename(newGitMarks, prevGitMarks))
+
+		var imported []string
+		for mark := range keys {
+			if commit, ok := gm.byMark[markNumber(mark)]; ok {
+				imported = append(imported, commit)
+			}
+		}
+		trees, err := git.CommitTrees(imported)
+		must(err)
+
+		for mark, key := range keys {
+			revid, ok := bm.byMark[markNumber(mark)]
+			if !ok {
+				continue
+			}
+			if _, ok := pairs[revid]; ok {
+				continue
+			}
+			tree := trees[gm.byMark[markNumber(mark)]]
+			if tree == "" {
+				unknown++
+				continue
+			}
+			switch candidates := byKey[tree+key]; len(candidates) {
+			case 0:
+				unknown++
+			case 1:
+				pairs[revid] = candidates[0]
+				matched++
+			default:
+				ambiguous++
+			}
+		}
+	}
+	log.Infof("Matched %d bzr revisions to git commits, %d ambiguous, %d not found in git",
+		matched, ambiguous, unknown)
+}
+
+func emptyTempFile(prefix string) string {
+	f, err := ioutil.TempFile(tmpDir, prefix)
+	must(err)
+	f.Close()
+	return f.Name()
+}
+
+// Run bzr fast-export of the branch and import it into git passing the stream
+// through filters. Returns names of the new bzr and git marks files.
+func exportBzrBranch(b *branchInfo, inBzrMarks, inGitMarks string, filters []fastimport.Filter) (string, string) {
+	newBzrMarks := emptyTempFile("bzr_marks")
+	newGitMarks := emptyTempFile("git_marks")
+	_, err := RunPipe(
+		bzr.Export(b.Bzr, b.Git, inBzrMarks, newBzrMarks),
+		git.Import(inGitMarks, newGitMarks),
+		nil, filters...)
+	must(err)
+	return newBzrMarks, newGitMarks
+}
+
+func identString(id *fastimport.Ident) string {
+	if id.Name == "" {
+		return "<" + id.Email + ">"
+	}
+	return id.Name + " <" + id.Email + ">"
+}
+
+// Unix time of the identity, without the time zone
+func identTime(id *fastimport.Ident) string {
+	if s := strings.Fields(id.When); len(s) > 0 {
+		return s[0]
+	}
+	return ""
+}
+
+func markNumber(mark string) int {
+	var n int
+	fmt.Sscanf(mark, ":%d", &n)
+	return n
+}
+
+// Add pairs which are missing from the marks files, keeping the existing marks.
+// Returns descriptions of conflicts between them.
+func mergeMarks(bm, gm *marks, pairs map[string]string) (conflicts []string) {
+	maxMark := 0
+	for mark := range bm.byMark {
+		if mark > maxMark {
+			maxMark = mark
+		}
+	}
+	for mark := range gm.byMark {
+		if mark > maxMark {
+			maxMark = mark
+		}
+	}
+
+	revids := make([]string, 0, len(pairs))
+	for revid := range pairs {
+		revids = append(revids, revid)
+	}
+	sort.Strings(revids)
+
+	conflict := func(format string, args ...interface{}) {
+		conflicts = append(conflicts, fmt.Sprintf(format, args...))
+	}
+	for _, revid := range revids {
+		commit := pairs[revid]
+		bmark, inBzr := bm.byRev[revid]
+		gmark, inGit := gm.byRev[commit]
+		switch {
+		case inBzr && inGit:
+			if bmark != gmark {
+				conflict(":%d bzr %s and :%d git %s should have the same mark", bmark, revid, gmark, commit)
+			}
+		case inBzr:
+			if other, ok := gm.byMark[bmark]; ok {
+				conflict(":%d git %s should be %s", bmark, other, commit)
+				continue
+			}
+			gm.set(bmark, commit)
+		case inGit:
+			if other, ok := bm.byMark[gmark]; ok {
+				conflict(":%d bzr %s should be %s", gmark, other, revid)
+				continue
+			}
+			bm.set(gmark, revid)
+		default:
+			maxMark++
+			bm.set(maxMark, revid)
+			gm.set(maxMark, commit)
+		}
+	}
+	return conflicts
+}
+
+// Diff between the old and new contents of the marks file in unified format,
+// with lines ordered by mark. Empty if nothing is changed.
+func marksDiff(path string, old, new *marks) string {
+	all := make(map[int]bool)
+	for mark := range old.byMark {
+		all[mark] = true
+	}
+	for mark := range new.byMark {
+		all[mark] = true
+	}
+	sorted := make([]int, 0, len(all))
+	for mark := range all {
+		sorted = append(sorted, mark)
+	}
+	sort.Ints(sorted)
+
+	// lines of both files, prefixed with ' ', '-' or '+'
+	var lines []string
+	for _, mark := range sorted {
+		o, inOld := old.byMark[mark]
+		n, inNew := new.byMark[mark]
+		if inOld && inNew && o == n {
+			lines = append(lines, fmt.Sprintf(" :%d %s", mark, o))
+			continue
+		}
+		if inOld {
+			lines = append(lines, fmt.Sprintf("-:%d %s", mark, o))
+		}
+		if inNew {
+			lines = append(lines, fmt.Sprintf("+:%d %s", mark, n))
+		}
+	}
+
+	const context = 3
+	var buf bytes.Buffer
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(lines); {
+		if lines[i][0] == ' ' {
+			i++
+			oldLine++
+			newLine++
+			continue
+		}
+		// hunk ends after context unchanged lines which aren't followed by a change
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for unchanged := 0; end < len(lines) && unchanged <= 2*context; end++ {
+			if lines[end][0] == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > i && lines[end-1][0] == ' ' {
+			end--
+		}
+		if end += context; end > len(lines) {
+			end = len(lines)
+		}
+
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		oldCount, newCount := 0, 0
+		for _, l := range lines[start:end] {
+			if l[0] != '+' {
+				oldCount++
+			}
+			if l[0] != '-' {
+				newCount++
+			}
+		}
+		oldLine, newLine = oldStart+oldCount, newStart+newCount
+		// empty ranges start at the line before them
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- a/%s\n+++ b/%s\n", path, path)
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, l := range lines[start:end] {
+			fmt.Fprintln(&buf, l)
+		}
+		i = end
+	}
+	return buf.String()
+}
+
+func repairMarksUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge repair-marks [-h] [-n] [-notes-only]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+repair-marks will restore entries missing from the marks files (e.g. after
+one of them was truncated). Pairs of bzr revisions and git commits are taken
+from git notes in ` + notesRef + ` if they are available. Then all bzr branches
+are exported (without importing anything) and their revisions are matched with
+git commits having the same tree, author, committer, dates and message.
+To find the trees, exported revisions are imported into git under
+` + repairRef + `, which is removed afterwards.
+
+Existing marks are never changed. Changes of both marks files are printed
+as a diff between their old and new contents, and conflicts between existing
+marks and the repository contents are reported as errors. With -n nothing
+is written.
+`)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/fastimport"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func replayCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	list := fs.Bool("l", false, "list archived streams")
+	inMarks := fs.String("marks", "", "marks file to import (defaults to the current one)")
+	outMarks := fs.String("export-marks", "", "save resulting marks into this file")
+	fs.Usage = func() { replayUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if *list {
+		all, err := listStreams()
+		must(err)
+		for _, s := range all {
+			if fs.NArg() > 0 && s.Branch != fs.Arg(0) {
+				continue
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%d\n", s.Id, s.Time.Format("2006-01-02 15:04:05"),
+				s.Direction, s.Branch, s.Size)
+		}
+		return
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id := fs.Arg(0)
+
+	// first pass: find out which branches the stream will create
+	f, gz, err := openStream(id)
+	must(err)
+	toBzr := gz.Comment == streamToBzr
+	var refs []string
+	collect := func(c fastimport.Command) (fastimport.Command, error) {
+		switch c := c.(type) {
+		case *fastimport.Commit:
+			refs = append(refs, c.Ref)
+		case *fastimport.Reset:
+			refs = append(refs, c.Ref)
+		}
+		return nil, nil
+	}
+	must(fastimport.Run(ioutil.Discard, gz, collect))
+	gz.Close()
+	f.Close()
+
+	// marks files are read by fast-import
+	lk := lockRepo()
+	defer lk.Release()
+
+	// temporary branches created by the stream are removed afterwards
+	var cleanup func()
+	if toBzr {
+		var dirs []string
+		for _, ref := range refs {
+			dir := filepath.FromSlash(path.Join(bzrRepo, strings.TrimPrefix(ref, "refs/heads/")))
+			if !exists(dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+		cleanup = func() {
+			for _, dir := range dirs {
+				os.RemoveAll(dir)
+			}
+		}
+	} else {
+		var newRefs []string
+		for _, ref := range refs {
+			if rev, err := git.ResolveRef(ref); err == nil && rev == "" {
+				newRefs = append(newRefs, ref)
+			}
+		}
+		cleanup = func() {
+			for _, ref := range newRefs {
+				git.DeleteRef(ref)
+			}
+		}
+	}
+
+	if *inMarks == "" {
+		*inMarks = gitMarks
+		if toBzr {
+			*inMarks = bzrMarks
+		}
+	}
+	if *outMarks == "" {
+		tmp, err := ioutil.TempFile(tmpDir, "replay_marks")
+		must(err)
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		*outMarks = tmp.Name()
+	}
+
+	var dst *exec.Cmd
+	if toBzr {
+		log.Infof("Replaying %s into bzr", id)
+		dst = bzr.Import(bzrRepo, *inMarks, *outMarks)
+	} else {
+		log.Infof("Replaying %s into git", id)
+		dst = git.Import(*inMarks, *outMarks)
+	}
+	defer cleanup()
+	must(feedStream(id, dst))
+	log.Info("Replay finished successfully")
+}
+
+// Feed archived stream into the fast-import command as it is
+func feedStream(id string, dst *exec.Cmd) error {
+	f, gz, err := openStream(id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer gz.Close()
+
+	pw, err := dst.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := dst.Start(); err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(pw, gz)
+	closeErr := pw.Close()
+	waitErr := dst.Wait()
+	for _, e := range []error{copyErr, waitErr, closeErr} {
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func replayUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge replay [-h] [-marks <file>] [-export-marks <file>] <stream id>")
+	fmt.Println("       git-bzr-bridge replay -l [<git branch>]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+If ArchiveStreams is set in ` + bridgeConfigName + `, every stream fed into
+git or bzr fast-import is saved compressed into ` + streamsDir + `
+(after all the filters, empty streams aren't saved). Old streams are never
+removed automatically.
+
+replay will feed the archived stream into git fast-import (for streams
+imported from bzr) or bzr fast-import (for pushes into bzr) once again,
+which makes failed imports reproducible without fetching anything.
+Temporary branches created by the stream are removed afterwards, so it
+only adds objects to the repository, and neither marks files nor branches
+of the bridge are changed. Resulting marks are discarded unless
+-export-marks is given.
+
+With -l it lists archived streams (all of them or only ones of the given
+git branch) as <stream id> <time> <direction> <git branch> <compressed size>.
+`)
+}
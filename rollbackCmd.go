@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func rollbackCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	list := fs.Bool("l", false, "list saved generations instead of rolling back")
+	to := fs.Int("to", 1, "generation to restore")
+	fs.Usage = func() { rollbackUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 || *to < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	lk := lockRepo()
+	defer lk.Release()
+
+	if *list {
+		all, err := generationNumbers()
+		must(err)
+		for _, n := range all {
+			g, err := loadGeneration(n)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			fmt.Printf("%d\t%s\t%s\n", n, g.Time.Format("2006-01-02 15:04:05"), g.Command)
+			for _, s := range g.Journal.Steps {
+				fmt.Println("  ", s)
+			}
+		}
+		return
+	}
+
+	// undo transactions from the latest one down to the requested one
+	j := new(journal)
+	for n := 1; n <= *to; n++ {
+		g, err := loadGeneration(n)
+		if os.IsNotExist(err) {
+			panic(fmt.Errorf("Generation %d doesn't exist", n))
+		}
+		must(err)
+		steps, cleanup := g.undoSteps()
+		j.Steps = append(j.Steps, steps...)
+		j.CleanupFiles = append(j.CleanupFiles, cleanup...)
+	}
+	for _, f := range generationFiles {
+		saved := filepath.Join(generationDir(*to), f)
+		if !exists(saved) {
+			continue
+		}
+		tmp := filepath.Join(tmpDir, "rollback-"+f)
+		os.Remove(tmp)
+		must(os.Link(saved, tmp))
+		j.Steps = append(j.Steps, &journalStep{Op: stepReplaceFile, From: tmp, To: f})
+		j.CleanupFiles = append(j.CleanupFiles, tmp)
+	}
+
+	log.Infof("Rolling back %d transactions", *to)
+	runJournal(j)
+}
+
+func rollbackUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge rollback [-h] [-l] [-to <n>]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+Before every import, push and change of the branch config git-bzr-bridge
+saves marks files and branch config as a generation in ` + stateDir + `.
+Generation 1 is the state before the latest change, 2 before the one
+preceding it, and so on. Only the last few generations are kept, their number
+is set by Generations in ` + bridgeConfigName + ` (defaults to 5, negative
+value disables them).
+
+rollback will undo the last <n> changes: it restores marks files and branch
+config from generation <n>, resets git branches and hidden bzr branches
+(including git branches moved by pushes) to where they were, and brings back
+removed branches. Upstream bzr branches and git tags aren't touched.
+Rollback is a change on its own, so 'rollback -to 1' right after it will
+undo it.
+
+With -l it lists saved generations together with commands which created them
+and their steps.
+`)
+}
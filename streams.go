@@ -0,0 +1,158 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// If ArchiveStreams is set in the bridge config, every fast-export stream
+// is saved into streamsDir as it was fed into fast-import, so that failed
+// imports and pushes can be replayed later without touching bzr servers.
+const streamsDir = "git-bzr-bridge-streams"
+
+// Directions of the streams
+const (
+	streamToGit = "to-git"
+	streamToBzr = "to-bzr"
+)
+
+type streamArchive struct {
+	Id string
+	f  *os.File
+	gz *gzip.Writer
+	// first write error, further writes are discarded after it
+	err error
+}
+
+// Stream metadata, kept in the gzip header
+type streamInfo struct {
+	Id        string
+	Branch    string
+	Direction string
+	Time      time.Time
+	Size      int64 // compressed
+}
+
+func streamPath(id string) string {
+	return filepath.Join(streamsDir, id+".gz")
+}
+
+// Start saving the stream of gitBranch. Returns nil if archive is disabled.
+func newStreamArchive(gitBranch string, toBzr bool) *streamArchive {
+	bc, err := loadBridgeConfig()
+	must(err)
+	if !bc.ArchiveStreams {
+		return nil
+	}
+	must(os.MkdirAll(streamsDir, 0777))
+
+	dir := streamToGit
+	if toBzr {
+		dir = streamToBzr
+	}
+	now := time.Now()
+	id := fmt.Sprintf("%s-%s-%s", now.Format("20060102-150405.000"), dir,
+		strings.Replace(gitBranch, "/", "_", -1))
+	f, err := os.OpenFile(streamPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	must(err)
+	// streams are big, so compression speed matters more than ratio
+	gz, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	must(err)
+	gz.Header = gzip.Header{Name: gitBranch, Comment: dir, ModTime: now}
+	return &streamArchive{Id: id, f: f, gz: gz}
+}
+
+// Writer for RunPipe, nil if archive is disabled
+func (a *streamArchive) writer() io.Writer {
+	if a == nil {
+		return nil
+	}
+	return a
+}
+
+// Errors are never returned, so that they don't break the import itself
+func (a *streamArchive) Write(p []byte) (int, error) {
+	if a.err == nil {
+		_, a.err = a.gz.Write(p)
+	}
+	return len(p), nil
+}
+
+// Finish the archive, empty streams aren't kept. Archive is only a debugging
+// aid, so errors are just logged.
+func (a *streamArchive) finish(size int64) {
+	if a == nil {
+		return
+	}
+	err := a.err
+	if cerr := a.gz.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err != nil:
+		log.Errorf("Can't save stream %s: %s", a.Id, err)
+		os.Remove(a.f.Name())
+	case size == 0:
+		os.Remove(a.f.Name())
+	default:
+		log.Infof("Saved stream as %s", a.Id)
+	}
+}
+
+// Open archived stream, caller must close both returned readers
+func openStream(id string) (*os.File, *gzip.Reader, error) {
+	f, err := os.Open(streamPath(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %s", f.Name(), err)
+	}
+	return f, gz, nil
+}
+
+// Metadata of all archived streams, ordered by time
+func listStreams() ([]*streamInfo, error) {
+	entries, err := ioutil.ReadDir(streamsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var all []*streamInfo
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".gz") {
+			continue
+		}
+		id := strings.TrimSuffix(e.Name(), ".gz")
+		f, gz, err := openStream(id)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		all = append(all, &streamInfo{
+			Id:        id,
+			Branch:    gz.Name,
+			Direction: gz.Comment,
+			Time:      gz.ModTime,
+			Size:      e.Size(),
+		})
+		gz.Close()
+		f.Close()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	return all, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/git"
+
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of git tags created for bzr tags
+const (
+	tagsLightweight = "lightweight"
+	tagsAnnotated   = "annotated"
+)
+
+const defaultTagNamespace = "refs/tags/"
+
+// Identity used for annotated tags created by the bridge
+const tagger = "git-bzr-bridge <git-bzr-bridge@localhost>"
+
+// Tag bridging settings of the branch
+type tagsInfo struct {
+	// lightweight or annotated
+	Kind string
+	// Prefix of git references for the tags. {branch} is replaced
+	// with the name of the git branch. Defaults to refs/tags/
+	Namespace string `json:",omitempty"`
+	// Allow deletion of bzr tags by deleting git tags
+	AllowDelete bool `json:",omitempty"`
+	// Pushed git tags reachable from several branches with the same
+	// namespace belong to this branch (e.g. release tags on trunk)
+	Primary bool `json:",omitempty"`
+}
+
+func (t *tagsInfo) validate() error {
+	if t.Kind != tagsLightweight && t.Kind != tagsAnnotated {
+		return fmt.Errorf("invalid kind of tags %q", t.Kind)
+	}
+	if t.Namespace != "" && (!strings.HasPrefix(t.Namespace, "refs/") || !strings.HasSuffix(t.Namespace, "/")) {
+		return fmt.Errorf("tag namespace %q should start with refs/ and end with /", t.Namespace)
+	}
+	return nil
+}
+
+// Git reference prefix for the tags of the branch
+func (b *branchInfo) tagNamespace() string {
+	ns := b.Tags.Namespace
+	if ns == "" {
+		ns = defaultTagNamespace
+	}
+	return strings.Replace(ns, "{branch}", b.Git, -1)
+}
+
+// Read tags of the bzr branch at path (which can be a url as well),
+// or nil if tags aren't bridged for the branch
+func fetchBzrTags(b *branchInfo, path string) map[string]string {
+	if b.Tags == nil {
+		return nil
+	}
+	tags, err := bzr.Tags(path)
+	must(err)
+	return tags
+}
+
+// Create git tags for the bzr tags of the branch. Tags pointing to
+// revisions which weren't imported and tags conflicting with already
+// existing git tags are skipped.
+// Caller must hold repository lock.
+func importBzrTags(b *branchInfo, tags map[string]string) {
+	if b.Tags == nil || len(tags) == 0 {
+		return
+	}
+	mi := openMarksIndex()
+	defer mi.Close()
+
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ns := b.tagNamespace()
+	created := 0
+	for _, name := range names {
+		revid := tags[name]
+		ref := ns + name
+		if !git.CheckRefFormat(ref) {
+			log.Errorf("Skipping tag %q: %q isn't a valid git reference", name, ref)
+			continue
+		}
+		mark, ok := markOf(mi.bzr, revid)
+		if !ok {
+			log.Infof("Skipping tag %q: revision %s wasn't imported", name, revid)
+			continue
+		}
+		commit, ok := revOf(mi.git, mark)
+		if !ok {
+			log.Errorf("Skipping tag %q: can't find mark %d in git marks file", name, mark)
+			continue
+		}
+
+		existing, err := git.ResolveRef(ref + "^{commit}")
+		must(err)
+		if existing == commit {
+			continue
+		}
+		if existing != "" {
+			// most likely the same tag name is used in several branches
+			log.Errorf("Skipping tag %q of %q: %s already points to %s instead of %s",
+				name, b.Git, ref, existing, commit)
+			continue
+		}
+
+		target := commit
+		if b.Tags.Kind == tagsAnnotated {
+			msg := fmt.Sprintf("bzr tag %s\n\nrevision-id: %s", name, revid)
+			target, err = git.MkTag(name, commit, tagger, msg)
+			must(err)
+		}
+		must(git.UpdateRef(ref, target))
+		created++
+	}
+	if created > 0 {
+		log.Infof("Created %d tags for %q", created, b.Git)
+	}
+}
+
+// Find branches which can own the tag reference, longest namespaces first
+func tagBranches(c *branchConfig, ref string) branchList {
+	var res branchList
+	for _, b := range c.branches {
+		if b.Tags != nil && strings.HasPrefix(ref, b.tagNamespace()) {
+			res = append(res, b)
+		}
+	}
+	sort.Stable(byTagNamespace{res})
+	return res
+}
+
+type byTagNamespace struct{ branchList }
+
+func (x byTagNamespace) Less(i, j int) bool {
+	return len(x.branchList[i].tagNamespace()) > len(x.branchList[j].tagNamespace())
+}
+func (x byTagNamespace) Len() int      { return len(x.branchList) }
+func (x byTagNamespace) Swap(i, j int) { x.branchList[i], x.branchList[j] = x.branchList[j], x.branchList[i] }
+
+// Choose branch which the tag pointing to commit belongs to. It's the one
+// containing the commit among the branches with the longest namespace. If there
+// are several, the one whose tip is the commit wins, then the primary one.
+// tips override tips of git branches which are being pushed together with the tag.
+func tagOwner(candidates branchList, ref, commit string, tips map[string]string) *branchInfo {
+	tip := func(b *branchInfo) string {
+		if t, ok := tips[b.Git]; ok {
+			return t
+		}
+		t, err := git.ResolveRef("refs/heads/" + b.Git)
+		must(err)
+		return t
+	}
+
+	var found branchList
+	for _, c := range candidates {
+		if len(found) > 0 && len(c.tagNamespace()) < len(found[0].tagNamespace()) {
+			break
+		}
+		t := tip(c)
+		if t == "" {
+			continue
+		}
+		ok, err := git.IsAncestor(commit, t)
+		must(err)
+		if ok {
+			found = append(found, c)
+		}
+	}
+	if len(found) == 0 {
+		panic(fmt.Errorf("Commit %s of tag %q isn't on any bridged branch", commit, ref))
+	}
+	if len(found) == 1 {
+		return found[0]
+	}
+
+	var atTip, primary branchList
+	for _, c := range found {
+		if tip(c) == commit {
+			atTip = append(atTip, c)
+		}
+		if c.Tags.Primary {
+			primary = append(primary, c)
+		}
+	}
+	switch {
+	case len(atTip) == 1:
+		return atTip[0]
+	case len(primary) == 1:
+		return primary[0]
+	}
+	panic(fmt.Errorf("Tag %q is ambiguous: it can belong to %q and %q, mark one of them as Primary in the tags config",
+		ref, found[0].Git, found[1].Git))
+}
+
+// Check that push of git tag reference can be bridged, without changing
+// anything. Returns the branch owning the tag, name of the bzr tag and
+// bzr revision it should point to (empty for deletions). See tagOwner for tips.
+func checkTagPush(candidates branchList, ref, oldRev, newRev string, tips map[string]string) (b *branchInfo, name, revid string) {
+	if oldRev != emptyRef && newRev != emptyRef {
+		panic(fmt.Errorf("Moving tags is not supported"))
+	}
+	rev := newRev
+	if rev == emptyRef {
+		rev = oldRev
+	}
+	commit, err := git.ResolveRef(rev + "^{commit}")
+	must(err)
+	if commit == "" {
+		panic(fmt.Errorf("Tag %q doesn't point to a commit", ref))
+	}
+
+	b = tagOwner(candidates, ref, commit, tips)
+	name = ref[len(b.tagNamespace()):]
+	must(b.checkPushable())
+	if newRev == emptyRef {
+		if !b.Tags.AllowDelete {
+			panic(fmt.Errorf("Deletion of tags isn't allowed for %q", b.Git))
+		}
+		return b, name, ""
+	}
+
+	revid, ok := func() (string, bool) {
+		repoLk := lockRepo()
+		defer repoLk.Release()
+		return bzrRevision(commit)
+	}()
+	if !ok {
+		// it will be exported by the push of the branch itself,
+		// either together with the tag or later from the queue
+		bc, err := loadBridgeConfig()
+		must(err)
+		if _, pushed := tips[b.Git]; pushed || bc.Async {
+			return b, name, ""
+		}
+		panic(fmt.Errorf("Commit %s of tag %q hasn't been exported into bzr yet", commit, ref))
+	}
+	return b, name, revid
+}
+
+// Create or delete bzr tag according to the push of git tag reference.
+// See tagOwner for tips.
+func pushTag(candidates branchList, ref, oldRev, newRev string, tips map[string]string) {
+	b, name, revid := checkTagPush(candidates, ref, oldRev, newRev, tips)
+
+	lk := lockBranch(b.Git)
+	defer lk.Release()
+
+	if newRev == emptyRef {
+		log.Infof("Deleting tag %q of %q", name, b.Url)
+		must(bzr.DeleteTag(b.Url, name))
+		must(bzr.DeleteTag(b.Bzr, name))
+		return
+	}
+
+	// commit could have been exported by the push of its branch just now
+	if revid == "" {
+		var ok bool
+		revid, ok = func() (string, bool) {
+			repoLk := lockRepo()
+			defer repoLk.Release()
+			rev, err := git.ResolveRef(newRev + "^{commit}")
+			must(err)
+			return bzrRevision(rev)
+		}()
+		if !ok {
+			panic(fmt.Errorf("Commit of tag %q hasn't been exported into bzr yet", ref))
+		}
+	}
+
+	log.Infof("Creating tag %q in %q", name, b.Url)
+	must(bzr.SetTag(b.Url, name, revid))
+	must(bzr.SetTag(b.Bzr, name, revid))
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"github.com/usovalx/git-bzr-bridge/bzr"
-	"github.com/usovalx/git-bzr-bridge/git"
 
 	"flag"
 	"fmt"
 	"os"
+	"sync"
 )
 
 func updateCmd(args []string) {
@@ -14,6 +14,8 @@ func updateCmd(args []string) {
 	fs := flag.NewFlagSet("update", flag.ExitOnError)
 	help := fs.Bool("h", false, "show usage message")
 	updateAll := fs.Bool("a", false, "update all branches")
+	checkOnly := fs.Bool("check-only", false, "only report branches which have new revisions in bzr")
+	jobs := fs.Int("j", 1, "number of branches to fetch from bzr in parallel")
 	fs.Usage = func() { updateUsage(fs) }
 	fs.Parse(args)
 
@@ -22,7 +24,7 @@ func updateCmd(args []string) {
 		os.Exit(0)
 	}
 
-	if (*updateAll && fs.NArg() != 0) || (!*updateAll && fs.NArg() == 0) {
+	if (*updateAll && fs.NArg() != 0) || (!*updateAll && fs.NArg() == 0) || *jobs < 1 {
 		fs.Usage()
 		os.Exit(2)
 	}
@@ -33,23 +35,50 @@ func updateCmd(args []string) {
 	var toUpdate []string
 	if *updateAll {
 		for _, v := range branchConfig.branches {
-			toUpdate = append(toUpdate, v.Git)
+			if !v.Frozen && v.mode() != modePush {
+				toUpdate = append(toUpdate, v.Git)
+			}
 		}
 	} else {
 		toUpdate = fs.Args()
 	}
 
-	errors := false
-	for _, branch := range toUpdate {
-		if v, ok := branchConfig.byGitName[branch]; ok {
-			if e := doUpdateBranch(v.Git, v.Bzr, v.Url); e != nil {
-				log.Error(e)
-				errors = true
+	if *checkOnly {
+		checkBranches(branchConfig, toUpdate)
+		return
+	}
+
+	// fetching from bzr runs in parallel, while importing into git
+	// is serialized by the repository lock
+	results := make([]string, len(toUpdate))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < *jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = updateBranch(branchConfig, toUpdate[i])
 			}
-		} else {
-			log.Errorf("Branch %q isn't valid", branch)
+		}()
+	}
+	for i := range toUpdate {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	errors := false
+	if len(toUpdate) > 1 {
+		log.Info("Summary:")
+	}
+	for i, branch := range toUpdate {
+		if results[i] != resultUpdated && results[i] != resultUpToDate {
 			errors = true
 		}
+		if len(toUpdate) > 1 {
+			log.Infof("  %s: %s", branch, results[i])
+		}
 	}
 
 	if errors {
@@ -57,23 +86,89 @@ func updateCmd(args []string) {
 	}
 }
 
+const (
+	resultUpdated  = "updated"
+	resultUpToDate = "up to date"
+)
+
+// Update single branch and return short description of the result
+func updateBranch(c *branchConfig, branch string) string {
+	v, ok := c.byGitName[branch]
+	if !ok {
+		log.Errorf("Branch %q isn't valid", branch)
+		return "invalid branch"
+	}
+	if v.Frozen {
+		log.Errorf("Branch %q is archived", branch)
+		return "archived"
+	}
+	if v.mode() == modePush {
+		log.Errorf("Branch %q is push-only", branch)
+		return "push-only"
+	}
+	updated, err := doUpdateBranch(v)
+	if err != nil {
+		log.Error(err)
+		return "failed: " + err.Error()
+	}
+	if updated {
+		return resultUpdated
+	}
+	return resultUpToDate
+}
+
+// Print names of the branches which have new revisions upstream
+func checkBranches(c *branchConfig, toCheck []string) {
+	errors := false
+	for _, branch := range toCheck {
+		v, ok := c.byGitName[branch]
+		if !ok {
+			log.Errorf("Branch %q isn't valid", branch)
+			errors = true
+			continue
+		}
+		upToDate, err := isUpToDate(v.Bzr, v.Url)
+		if err != nil {
+			log.Errorf("Can't check %q: %s", branch, err)
+			errors = true
+		} else if !upToDate {
+			fmt.Println(branch)
+		}
+	}
+
+	if errors {
+		panic(fmt.Errorf("Some branches failed to check"))
+	}
+}
+
 func updateUsage(fs *flag.FlagSet) {
-	fmt.Println("usage: git-bzr-bridge update [-h] [-a] [<branch>]")
+	fmt.Println("usage: git-bzr-bridge update [-h] [-check-only] [-j <n>] [-a] [<branch>]")
 	fmt.Println("\nflags:")
 	fs.SetOutput(os.Stdout)
 	fs.PrintDefaults()
 
 	fmt.Print(`
 update specified <branch> or all known branches (if -a is specified). Essentially
-will pull new revisions from bzr and import them into git.
+will pull new revisions from bzr and import them into git. Archived and push-only
+branches are skipped.
 
 If multiple branches are specified it will try to updates them all. When updating
 multiple branches, update won't stop early on errors and will try to update all
-requested branches.
+requested branches. With -j <n> it will fetch up to <n> branches from bzr
+in parallel; importing into git is still done one branch at a time.
+
+With -check-only it won't update anything and will just print names of the
+branches which have new revisions in bzr.
+
+If Notes is set in ` + bridgeConfigName + `, bzr revision id and revno of every
+imported or pushed commit are recorded as a git note in ` + notesRef + `.
+Clients can fetch them by adding the refspec to their remote (see
+install-hooks -h) and see them with "git log --notes=bzr".
 `)
 }
 
-func doUpdateBranch(gitBranch, bzrBranch, url string) (err error) {
+func doUpdateBranch(b *branchInfo) (updated bool, err error) {
+	gitBranch, bzrBranch, url := b.Git, b.Bzr, b.Url
 	log.Infof("Updating %q from %q", gitBranch, url)
 
 	// capture any panics and convert them into errors
@@ -87,18 +182,64 @@ func doUpdateBranch(gitBranch, bzrBranch, url string) (err error) {
 		}
 	}()
 
-	cloneAndExportBzrImportGit(
-		url,
+	lk := lockBranch(gitBranch)
+	defer lk.Release()
+
+	upToDate, err := isUpToDate(bzrBranch, url)
+	must(err)
+	if upToDate {
+		log.Infof("%q is up to date", gitBranch)
+		// tags could have been changed without any new revisions
+		if tags := fetchBzrTags(b, url); tags != nil {
+			repoLk := lockRepo()
+			defer repoLk.Release()
+			importBzrTags(b, tags)
+		}
+		return false, nil
+	}
+
+	updated = cloneAndExportBzrImportGit(
+		url, bzrBranch, gitBranch,
 		checkIfBranchUpdated(bzrBranch),
-		func(marksUpdated bool, tmpGitMarks, tmpBzrMarks, tmpGitBranch, tmpBzrBranch string) {
-			must(bzr.PullOverwrite(tmpBzrBranch, bzrBranch))
-			must(git.RenameBranch(tmpGitBranch, gitBranch))
-			if marksUpdated {
-				must(os.Rename(tmpBzrMarks, bzrMarks))
-				must(os.Rename(tmpGitMarks, gitMarks))
+		updateFinalizer(b))
+	return updated, nil
+}
+
+// Finalizer for cloneAndExportBzrImportGit which will update existing branches
+func updateFinalizer(b *branchInfo) func(bool, string, string, string, string) {
+	return func(marksUpdated bool, tmpGitMarks, tmpBzrMarks, tmpGitBranch, tmpBzrBranch string) {
+		tags := fetchBzrTags(b, tmpBzrBranch)
+		j := &journal{
+			Steps: []*journalStep{
+				{Op: stepBzrPull, From: tmpBzrBranch, To: b.Bzr},
+				{Op: stepGitBranch, From: tmpGitBranch, To: b.Git},
+			},
+			CleanupFiles:    []string{tmpGitMarks, tmpBzrMarks, tmpBzrBranch},
+			CleanupBranches: []string{tmpGitBranch},
+		}
+		if marksUpdated {
+			j.Steps = append(j.Steps, marksSteps(tmpGitMarks, tmpBzrMarks)...)
+			if s := notesStep(tmpGitMarks, tmpBzrMarks, tmpBzrBranch, b.Git); s != nil {
+				j.Steps = append(j.Steps, s)
 			}
-		})
-	return nil
+		}
+		runJournal(j)
+		importBzrTags(b, tags)
+	}
+}
+
+// Cheap check whether upstream branch has new revisions, which
+// costs one round-trip and doesn't fetch anything
+func isUpToDate(bzrBranch, url string) (bool, error) {
+	localTip, err := bzr.Tip(bzrBranch)
+	if err != nil {
+		return false, err
+	}
+	remoteTip, err := bzr.RemoteTip(url)
+	if err != nil {
+		return false, err
+	}
+	return localTip == remoteTip, nil
 }
 
 func checkIfBranchUpdated(oldBranch string) func(string) bool {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/usovalx/git-bzr-bridge/bzr"
+	"github.com/usovalx/git-bzr-bridge/fastimport"
 	"github.com/usovalx/git-bzr-bridge/git"
 
 	"flag"
@@ -13,6 +14,9 @@ import (
 	"strings"
 )
 
+// Object name used by git for references being created or deleted
+const emptyRef = "0000000000000000000000000000000000000000"
+
 func updateHookCmd(args []string) {
 	// command-line flags
 	fs := flag.NewFlagSet("update-hook", flag.ExitOnError)
@@ -30,65 +34,159 @@ func updateHookCmd(args []string) {
 		os.Exit(2)
 	}
 
-	const emptyRef = "0000000000000000000000000000000000000000"
+	branchConfig, err := loadBranchConfig()
+	must(err)
+	bridgeConfig, err := loadBridgeConfig()
+	must(err)
+	if bridgeConfig.Async {
+		// export will be done later from the queue
+		u := &refUpdate{fs.Arg(1), fs.Arg(2), fs.Arg(0)}
+		must(checkRefUpdate(branchConfig, bridgeConfig, u, nil))
+		return
+	}
+	handleRefUpdate(branchConfig, fs.Arg(0), fs.Arg(1), fs.Arg(2), nil)
+}
 
-	// FIXME: should it make an exception for tags?
-	if fs.Arg(1) == emptyRef {
-		panic(fmt.Errorf("Creation of new references is not supported"))
+// Bridge single reference update pushed into git. tips are new tips of git
+// branches pushed at the same time, if they aren't updated in git yet.
+func handleRefUpdate(c *branchConfig, ref, oldRev, newRev string, tips map[string]string) {
+	// tags are bridged separately from branches
+	if candidates := tagBranches(c, ref); len(candidates) != 0 {
+		pushTag(candidates, ref, oldRev, newRev, tips)
+		return
 	}
 
-	if fs.Arg(2) == emptyRef {
-		panic(fmt.Errorf("Deletion of reference is not supported"))
+	gitBranch := pushedBranchName(ref)
+	if oldRev == emptyRef {
+		createBzrBranch(gitBranch, newRev)
+		return
 	}
 
-	// FIXME: locking
+	// find corresponding bzr branch
+	branch, ok := c.byGitName[gitBranch]
+	if !ok {
+		panic(fmt.Errorf("Unknown branch %q", gitBranch))
+	}
+	if newRev == emptyRef {
+		if git.InQuarantine() {
+			// already checked by checkRefUpdate, git refs can't be changed
+			// until the push is accepted, so post-receive hook will do it
+			return
+		}
+		deleteBranch(branch, oldRev)
+		return
+	}
+
+	lk := lockBranch(gitBranch)
+	defer lk.Release()
+
+	checkBranchPush(branch, oldRev, newRev)
+
+	// export git -> import bzr & push it
+	exportGitImportBzrAndPush(oldRev, newRev, branch)
+}
 
-	// trim "/refs/heads/" prefix from git reference
+// Trim "refs/heads/" prefix from git reference
+func pushedBranchName(ref string) string {
 	const prefix = "refs/heads/"
-	var gitBranch string
-	if !strings.HasPrefix(fs.Arg(0), prefix) {
-		log.Errorf("Unexpected reference name %q", fs.Arg(0))
-		os.Exit(1)
+	if !strings.HasPrefix(ref, prefix) {
+		panic(fmt.Errorf("Unexpected reference name %q", ref))
 	}
-	gitBranch = fs.Arg(0)[len(prefix):]
+	return ref[len(prefix):]
+}
 
-	// find corresponding bzr branch
-	branchConfig, err := loadBranchConfig()
+// Git is authoritative for push-only branches, so new revisions of their
+// upstream bzr branches are never imported
+func pushOnlyDiverged(b *branchInfo) error {
+	return fmt.Errorf("Upstream bzr branch %s of push-only branch %s has new revisions, "+
+		"they won't be imported and have to be reconciled by hand", b.Url, b.Git)
+}
+
+// Check that push into existing branch can be exported into bzr.
+// Caller must hold branch lock.
+func checkBranchPush(b *branchInfo, oldRev, newRev string) {
+	must(b.checkPushable())
+
+	// now let's try to update bazaar branch to reduce the possibility of diverged branches
+	upToDate, err := isUpToDate(b.Bzr, b.Url)
 	must(err)
-	var bzrBranch, url string
-	if c, ok := branchConfig.byGitName[gitBranch]; !ok {
-		log.Errorf("Unknown branch %q", gitBranch)
-		os.Exit(1)
-	} else {
-		bzrBranch = c.Bzr
-		url = c.Url
+	if !upToDate && b.mode() == modePush {
+		// git is authoritative for this branch, don't import anything
+		panic(pushOnlyDiverged(b))
+	}
+	if !upToDate && git.InQuarantine() {
+		// pre-receive hook can't update git branches
+		panic(fmt.Errorf("These branches have diverged, new bzr revisions will be imported by the next update"))
+	}
+	updated := !upToDate && cloneAndExportBzrImportGit(
+		b.Url, b.Bzr, b.Git,
+		checkIfBranchUpdated(b.Bzr),
+		updateFinalizer(b))
+	if updated {
+		panic(fmt.Errorf("These branches have diverged"))
 	}
 
-	// now let's try to update bazaar branch to reduce the possibility of diverged branches
-	updated := cloneAndExportBzrImportGit(
-		url,
-		checkIfBranchUpdated(bzrBranch),
-		// FIXME: move this bit into function
-		func(marksUpdated bool, tmpGitMarks, tmpBzrMarks, tmpGitBranch, tmpBzrBranch string) {
-			must(bzr.PullOverwrite(tmpBzrBranch, bzrBranch))
-			must(git.RenameBranch(tmpGitBranch, gitBranch))
-			if marksUpdated {
-				must(os.Rename(tmpBzrMarks, bzrMarks))
-				must(os.Rename(tmpGitMarks, gitMarks))
-			}
+	if !checkFastForward(oldRev, newRev) {
+		panic(fmt.Errorf("Not fast-forward push"))
+	}
+}
+
+// Apply deletion policy of the branch deleted by push. oldRev is the tip
+// of the branch before deletion, git branch itself could be already gone.
+func deleteBranch(b *branchInfo, oldRev string) {
+	must(b.checkMirror())
+
+	lk := lockBranch(b.Git)
+	defer lk.Release()
+
+	switch b.OnDelete {
+	case deleteUnregister:
+		repoLk := lockRepo()
+		defer repoLk.Release()
+		runJournal(removeBranchJournal(b, keepCommitsStep(b, oldRev), false))
+		log.Infof("Branch %q is unregistered, bzr branch %q is left untouched", b.Git, b.Url)
+	case deleteArchive:
+		repoLk := lockRepo()
+		defer repoLk.Release()
+		archived := *b
+		archived.Frozen = true
+		runJournal(&journal{
+			Steps: []*journalStep{
+				keepCommitsStep(b, oldRev),
+				{Op: stepSetBranch, Prev: b, Branch: &archived},
+			},
 		})
-	if updated {
-		log.Error("These branches have diverged")
-		os.Exit(1)
+		log.Infof("Branch %q is archived, bzr branch %q is left untouched", b.Git, b.Url)
+	default:
+		panic(fmt.Errorf("Deletion of branch %q is not allowed", b.Git))
 	}
+}
 
-	if !checkFastForward(fs.Arg(1), fs.Arg(2)) {
-		log.Error("Not fast-forward push")
-		os.Exit(1)
+// Create new bzr branch for the new git branch using url templates
+// from the bridge config
+func createBzrBranch(gitBranch, gitRev string) {
+	bc, err := loadBridgeConfig()
+	must(err)
+	b := bc.newBranch(gitBranch)
+	if b == nil {
+		panic(fmt.Errorf("Creation of new references is not supported: %q doesn't match any url template", gitBranch))
 	}
 
-	// export git -> import bzr & push it
-	exportGitImportBzrAndPush(fs.Arg(2), gitBranch, bzrBranch, url)
+	lk := lockBranch(gitBranch)
+	defer lk.Release()
+
+	// check for clashes again, now that we hold the lock
+	c, err := loadBranchConfig()
+	must(err)
+	if c.byGitName[b.Git] != nil || c.byBzrName[b.Bzr] != nil {
+		panic(fmt.Errorf("Branch %q is already known", gitBranch))
+	}
+	if exists(b.Bzr) {
+		panic(fmt.Errorf("Bzr branch %q already exists", b.Bzr))
+	}
+
+	log.Infof("Creating bzr branch %q for %q", b.Url, gitBranch)
+	exportGitImportBzrAndPush(emptyRef, gitRev, b)
 }
 
 func updateHookUsage(fs *flag.FlagSet) {
@@ -98,7 +196,23 @@ func updateHookUsage(fs *flag.FlagSet) {
 	fs.PrintDefaults()
 
 	fmt.Print(`
-update 
+update-hook should be called from the git update hook. It will export new
+revisions of the pushed branch into bzr and push them upstream.
+
+Deleted branches are handled according to the OnDelete policy of the branch
+in the branch config: "refuse" (default) rejects the push, "unregister" removes
+the branch from the config, "archive" keeps it but marks as frozen. Upstream bzr
+branch is never deleted.
+
+New branches can be created by pushing new git branches if their names
+match one of the url templates in ` + bridgeConfigName + `.
+
+Tags can be pushed into branches which have tags bridging enabled. Pushed tag
+must point to a commit which was already exported into bzr. Tags can't be moved,
+and can only be deleted if it is allowed in the branch config. If the commit is
+on several branches sharing the tag namespace, the tag goes to the branch whose
+tip is the commit, or otherwise to the one with Primary set in its tags config.
+Archived branches and mirrors don't accept tags.
 `)
 }
 
@@ -109,12 +223,11 @@ func checkFastForward(old, new string) bool {
 	return len(r) == 0
 }
 
-func exportGitImportBzrAndPush(
-	gitRev, gitBranch, bzrBranch, url string) {
-
-	// FIXME: use locks
-
-	tmpGitBranch := "__git_import/" + gitBranch
+// Export git revision pushed on top of oldRev into bzr and push it into the bzr
+// branch b. If oldRev is emptyRef, bzr branch is created from scratch and
+// registered in the branch config.
+func exportGitImportBzrAndPush(oldRev, gitRev string, b *branchInfo) {
+	tmpGitBranch := "__git_import/" + b.Git
 	tmpBzrBranch := filepath.FromSlash(path.Join(bzrRepo, tmpGitBranch))
 
 	// create all temp files we will need later
@@ -127,28 +240,32 @@ func exportGitImportBzrAndPush(
 	defer os.Remove(tmpGitMarks.Name())
 	tmpGitMarks.Close()
 
-	// create a temp branch in git
-	must(git.NewBranch(tmpGitBranch, gitRev))
-	defer git.RemoveBranch(tmpGitBranch)
+	// marks files are read at export and replaced when finalizing
+	lk := lockRepo()
+	defer lk.Release()
 
 	// export data into bzr
 	log.Info("Exporting data from git")
 	defer os.RemoveAll(tmpBzrBranch)
+	archive := newStreamArchive(b.Git, true)
+	// revision is exported by its name, pre-receive hook can't create branches
 	exportSize, err := RunPipe(
-		git.Export(tmpGitBranch, gitMarks, tmpGitMarks.Name()),
-		bzr.Import(bzrRepo, bzrMarks, tmpBzrMarks.Name()))
+		git.Export(gitRev, gitMarks, tmpGitMarks.Name()),
+		bzr.Import(bzrRepo, bzrMarks, tmpBzrMarks.Name()),
+		archive.writer(),
+		append([]fastimport.Filter{renameRefFilter(gitRev, "refs/heads/"+tmpGitBranch)}, streamFilters(true)...)...)
+	archive.finish(exportSize)
+	must(err)
 
 	if exportSize == 0 {
 		log.Info("Empty export. Creating bzr branch using marks")
-		b, err := loadMarks(bzrMarks)
-		must(err)
-		g, err := loadMarks(gitMarks)
-		must(err)
-		mark, ok := g.byRev[gitRev]
+		mi := openMarksIndex()
+		defer mi.Close()
+		mark, ok := markOf(mi.git, gitRev)
 		if !ok {
 			log.Panicf("Can't find revision %q in the git marks file", gitRev)
 		}
-		brev, ok := b.byMark[mark]
+		brev, ok := revOf(mi.bzr, mark)
 		if !ok {
 			log.Panicf("Can't find mark %d in bzr marks file", mark)
 		}
@@ -156,12 +273,51 @@ func exportGitImportBzrAndPush(
 	}
 
 	log.Info("Pushing into bzr")
-	must(bzr.Push(tmpBzrBranch, url))
+	must(bzr.Push(tmpBzrBranch, b.Url))
 
 	log.Info("Finalizing")
-	must(bzr.PullOverwrite(tmpBzrBranch, bzrBranch))
+	j := &journal{
+		Steps: []*journalStep{
+			{Op: stepBzrPull, From: tmpBzrBranch, To: b.Bzr},
+		},
+		CleanupFiles: []string{tmpGitMarks.Name(), tmpBzrMarks.Name(), tmpBzrBranch},
+	}
+	oldTip := oldRev
+	if oldRev == emptyRef {
+		oldTip = ""
+		j.Steps = []*journalStep{
+			{Op: stepRenameDir, From: tmpBzrBranch, To: b.Bzr},
+			{Op: stepAddBranch, Branch: b},
+		}
+	}
+	// git moves the branch itself, rollback needs to know where it was
+	j.Steps = append(j.Steps, &journalStep{Op: stepPushRef, From: gitRev, To: "refs/heads/" + b.Git, Undo: oldTip})
 	if exportSize != 0 {
-		must(os.Rename(tmpBzrMarks.Name(), bzrMarks))
-		must(os.Rename(tmpGitMarks.Name(), gitMarks))
+		j.Steps = append(j.Steps, marksSteps(tmpGitMarks.Name(), tmpBzrMarks.Name())...)
+		notes := newNotes(tmpGitMarks.Name(), tmpBzrMarks.Name(), tmpBzrBranch, b.Git)
+		if git.InQuarantine() {
+			// added once the push is accepted
+			pushedNotes = append(pushedNotes, notes...)
+		} else if s := notesCommitStep(notes, b.Git); s != nil {
+			j.Steps = append(j.Steps, s)
+		}
+	}
+	runJournal(j)
+}
+
+// Rename reference in the fast-export stream
+func renameRefFilter(from, to string) fastimport.Filter {
+	return func(c fastimport.Command) (fastimport.Command, error) {
+		switch c := c.(type) {
+		case *fastimport.Commit:
+			if c.Ref == from {
+				c.Ref = to
+			}
+		case *fastimport.Reset:
+			if c.Ref == from {
+				c.Ref = to
+			}
+		}
+		return c, nil
 	}
 }
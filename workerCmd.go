@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func workerCmd(args []string) {
+	// command-line flags
+	fs := flag.NewFlagSet("worker", flag.ExitOnError)
+	help := fs.Bool("h", false, "show usage message")
+	fs.Usage = func() { workerUsage(fs) }
+	fs.Parse(args)
+
+	if *help {
+		fs.Usage()
+		os.Exit(0)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	bridgeConfig, err := loadBridgeConfig()
+	must(err)
+	if !drainQueue(bridgeConfig.MaxAttempts) {
+		panic(fmt.Errorf("Some jobs failed"))
+	}
+}
+
+func workerUsage(fs *flag.FlagSet) {
+	fmt.Println("usage: git-bzr-bridge worker [-h]")
+	fmt.Println("\nflags:")
+	fs.SetOutput(os.Stdout)
+	fs.PrintDefaults()
+
+	fmt.Print(`
+worker will export all queued pushes into bzr in the order they were
+received. Failed jobs stay in the queue and are retried by the next run
+of the worker, up to MaxAttempts times (see ` + bridgeConfigName + `).
+Only one worker can run at a time.
+
+It's supposed to be run periodically, e.g. from cron.
+`)
+}